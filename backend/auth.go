@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	accessTokenTTL  = envDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL = envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+)
+
+// satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// short-lived access token and the refresh token that rotates it
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+func authenticate(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.Header.Get("Authorization")
+		if tokenString == "" {
+			http.Error(w, "Authorization token required", http.StatusUnauthorized)
+			return
+		}
+
+		user, _, err := validateToken(db, tokenString)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// user resolved by authenticate, nil on public routes
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// parse the bearer token from an Authorization header and resolve its user, rejecting
+// denylisted tokens and tokens issued before the user's last password change
+func validateToken(db *sql.DB, header string) (*User, jwt.MapClaims, error) {
+	claims, err := parseJWT(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		return nil, nil, err
+	}
+	// special purpose tokens such as the mfa step of a login are not access tokens
+	if _, ok := claims["purpose"]; ok {
+		return nil, nil, errors.New("not an access token")
+	}
+
+	userID, ok := tokenSubject(claims)
+	if !ok {
+		return nil, nil, errors.New("token has no subject")
+	}
+	role, _ := claims["role"].(string)
+	version, _ := claims["ver"].(float64)
+	jti, _ := claims["jti"].(string)
+
+	var u User
+	var currentVersion int
+	var revoked bool
+	err = db.QueryRow(`SELECT id, username, email, role, created_at, updated_at, token_version,
+			EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $2)
+		FROM users WHERE id = $1`, userID, jti).Scan(
+		&u.Id, &u.Username, &u.Email, &u.Role, &u.CreatedAt, &u.UpdatedAt, &currentVersion, &revoked)
+	if err != nil {
+		return nil, nil, errors.New("unknown user")
+	}
+	if revoked || int(version) != currentVersion {
+		return nil, nil, errors.New("token has been revoked")
+	}
+	// role changes bump the token version, so a mismatch here means a forged or stale claim
+	if role != "" && role != u.Role {
+		return nil, nil, errors.New("token role does not match")
+	}
+	return &u, claims, nil
+}
+
+// the user id a token was issued to. tokens name users by id rather than username, so a
+// renamed user's old name handed to someone else never resolves to the new account
+func tokenSubject(claims jwt.MapClaims) (int, bool) {
+	sub, _ := claims["sub"].(string)
+	id, err := strconv.Atoi(sub)
+	return id, err == nil
+}
+
+// verify the signature and expiry of a token signed with secretKey
+func parseJWT(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return secretKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// user behind the request's token if it carries a valid one, for public routes that show more to logged in users
+func optionalUser(db *sql.DB, r *http.Request) *User {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil
+	}
+	user, _, err := validateToken(db, header)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// users may read and edit their own record, user managers may handle everyone's
+func canManageUser(u *User, id string) bool {
+	return hasPermission(u, permManageUsers) || (u != nil && strconv.Itoa(u.Id) == id)
+}
+
+// check that the current user may edit the work, writing 404 or 403 otherwise.
+// without permEditAnyWork only unpublished works the user owns can be edited. works in the trash count as not found
+func authorizeWork(db *sql.DB, w http.ResponseWriter, r *http.Request, id string) bool {
+	var ownerID sql.NullInt64
+	var isPublished bool
+	err := db.QueryRow(`SELECT user_id, is_published FROM works WHERE id = $1 AND deleted_at IS NULL`, id).Scan(&ownerID, &isPublished)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Work not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch work details: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	u := currentUser(r)
+	if hasPermission(u, permEditAnyWork) {
+		return true
+	}
+	if u == nil || !ownerID.Valid || int(ownerID.Int64) != u.Id {
+		http.Error(w, "You do not have access to this work", http.StatusForbidden)
+		return false
+	}
+	if isPublished {
+		http.Error(w, "Only drafts can be edited without the publish role", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sign an access token and store a new refresh token, an empty family starts a new login session
+func issueTokens(q execer, userID int, username, role string, version int, family string) (tokenPair, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      strconv.Itoa(userID),
+		"username": username,
+		"role":     role,
+		"ver":      version,
+		"jti":      jti,
+		"exp":      time.Now().Add(accessTokenTTL).Unix(),
+	})
+	tokenString, err := token.SignedString(secretKey)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	if family == "" {
+		if family, err = randomHex(16); err != nil {
+			return tokenPair{}, err
+		}
+	}
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	_, err = q.Exec(`INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')`,
+		userID, hashRefreshToken(refreshToken), family, int(refreshTokenTTL.Seconds()))
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func adminLogin(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var admin User
+
+		if err := json.NewDecoder(r.Body).Decode(&admin); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(admin.Username) > 255 {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		ip := clientIP(r)
+		retryAfter, err := loginRetryAfter(db, admin.Username, ip)
+		if err != nil {
+			http.Error(w, "Failed to check login attempts: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if retryAfter > 0 {
+			recordLoginAttempt(db, admin.Username, ip, false, reasonThrottled)
+			writeRetryAfter(w, retryAfter)
+			http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		var userID, tokenVersion int
+		var storedPassword, role string
+		var totpEnabled bool
+
+		err = db.QueryRow("SELECT id, password, role, token_version, totp_enabled FROM users WHERE username = $1", admin.Username).Scan(
+			&userID, &storedPassword, &role, &tokenVersion, &totpEnabled)
+		if err != nil {
+			recordLoginAttempt(db, admin.Username, ip, false, "unknown user")
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(admin.Password)); err != nil {
+			recordLoginAttempt(db, admin.Username, ip, false, "wrong password")
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		// with two-factor authentication the password only earns a short-lived token for loginTOTP
+		if totpEnabled {
+			mfaToken, err := issueMFAToken(userID, admin.Username, tokenVersion)
+			if err != nil {
+				http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"mfa_required": true,
+				"mfa_token":    mfaToken,
+			})
+			return
+		}
+		recordLoginAttempt(db, admin.Username, ip, true, "")
+
+		tokens, err := issueTokens(db, userID, admin.Username, role, tokenVersion, "")
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+// exchange a refresh token for a new token pair, the presented refresh token is used up
+func refreshTokens(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "Refresh token required", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var tokenID, userID, tokenVersion int
+		var family, username, role string
+		var revoked, expired bool
+		err = tx.QueryRow(`
+			SELECT rt.id, rt.user_id, rt.family_id, rt.revoked_at IS NOT NULL, rt.expires_at < NOW(), u.username, u.role, u.token_version
+			FROM refresh_tokens rt
+			JOIN users u ON u.id = rt.user_id
+			WHERE rt.token_hash = $1
+			FOR UPDATE OF rt`, hashRefreshToken(req.RefreshToken)).Scan(
+			&tokenID, &userID, &family, &revoked, &expired, &username, &role, &tokenVersion)
+		if err != nil {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+
+		// a rotated token being presented again means it leaked, end the whole session
+		if revoked {
+			if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, family); err == nil {
+				tx.Commit()
+			}
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if expired {
+			http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+			return
+		}
+
+		if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1`, tokenID); err != nil {
+			http.Error(w, "Failed to rotate refresh token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := issueTokens(tx, userID, username, role, tokenVersion, family)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+// revoke the presented access token and the refresh token session it belongs to,
+// or every session of the user when "all" is set
+func adminLogout(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, claims, err := validateToken(db, r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+			All          bool   `json:"all"`
+		}
+		// the body is optional, a bare logout only revokes the access token
+		json.NewDecoder(r.Body).Decode(&req)
+
+		jti, _ := claims["jti"].(string)
+		exp, _ := claims["exp"].(float64)
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if jti != "" {
+			remaining := int(time.Until(time.Unix(int64(exp), 0)).Seconds()) + 1
+			_, err = tx.Exec(`INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, NOW() + $2 * INTERVAL '1 second')
+				ON CONFLICT (jti) DO NOTHING`, jti, remaining)
+			if err != nil {
+				http.Error(w, "Failed to revoke token: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if req.All {
+			_, err = tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, user.Id)
+		} else if req.RefreshToken != "" {
+			_, err = tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW()
+				WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)
+				AND user_id = $2 AND revoked_at IS NULL`,
+				hashRefreshToken(req.RefreshToken), user.Id)
+		}
+		if err != nil {
+			http.Error(w, "Failed to revoke refresh tokens: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// denylist entries are only needed until the token would have expired anyway
+		if _, err := tx.Exec(`DELETE FROM revoked_tokens WHERE expires_at < NOW()`); err != nil {
+			http.Error(w, "Failed to prune revoked tokens: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	}
+}
+
+func authHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{}`))
+}
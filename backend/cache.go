@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cache-Control values per kind of route, anything not listed is no-store
+const (
+	// anonymous reads of public routes, revalidated with their etag once a minute is up
+	publicCacheControl = "public, max-age=60"
+	// reads that depend on the user, browsers keep them but always revalidate
+	privateCacheControl = "private, no-cache"
+	// content addressed uploads never change
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	// uploads named before content addressing
+	uploadCacheControl = "public, max-age=86400"
+)
+
+// api responses carry user data and tokens unless a route says otherwise
+func noStoreMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// set the Cache-Control of a route on 200 and 304 responses. errors keep no-store so a shared
+// cache doesn't hold on to a transient failure
+func cacheControl(value string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: value}, r)
+	})
+}
+
+// Cache-Control of public routes. a request with a token may see drafts, so only anonymous
+// responses go to shared caches, and Vary keeps those caches from mixing the two
+func publicCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		value := publicCacheControl
+		if r.Header.Get("Authorization") != "" {
+			value = privateCacheControl
+		}
+		cacheControl(value, next).ServeHTTP(w, r)
+	})
+}
+
+// sets Cache-Control once the status of the response is known
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if status == http.StatusOK || status == http.StatusNotModified {
+			cw.Header().Set("Cache-Control", cw.value)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheControlWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// set the validators of a response and answer 304 when the client's copy is still current.
+// If-Modified-Since is only looked at without If-None-Match, as RFC 9110 asks
+func notModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	match := false
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		match = etagMatches(header, etag)
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.IsZero() {
+		// Last-Modified only has whole seconds
+		match = !lastModified.Truncate(time.Second).After(since)
+	}
+	if !match {
+		return false
+	}
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// whether an If-None-Match header names the etag, weak validators compare equal as RFC 9110 asks
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validators of a single work from its updated_at, which every change to the work bumps
+func workValidators(id int, updatedAt time.Time) (string, time.Time) {
+	return fmt.Sprintf(`W/"work-%d-%d"`, id, updatedAt.UnixNano()), updatedAt
+}
+
+// validators of a works listing without fetching the page. the last change to any work, trash
+// included, is the Last-Modified. the etag adds the number of matching works, the request uri
+// and the user, since those decide what the page holds
+func listingValidators(db *sql.DB, r *http.Request, filter workFilter) (string, time.Time, error) {
+	var count int
+	var lastModified sql.NullTime
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM works`+filter.where()+`),
+			(SELECT MAX(GREATEST(updated_at, deleted_at)) FROM works)`, filter.args...).Scan(&count, &lastModified)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	userID := 0
+	if user := currentUser(r); user != nil {
+		userID = user.Id
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d|%d|%d|%s", count, lastModified.Time.UnixNano(), userID, r.URL.RequestURI()))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`, lastModified.Time, nil
+}
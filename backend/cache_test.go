@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header, etag string
+		want         bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`"a"`, `"b"`, false},
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`W/"a"`, `W/"a"`, true},
+		{`"b", W/"a"`, `W/"a"`, true},
+		{`"b",  "c"`, `W/"a"`, false},
+		{`*`, `W/"a"`, true},
+		{`a`, `"a"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%s, %s) = %v, want %v", tt.header, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	etag := `W/"work-1-5"`
+	modified := time.Date(2024, 5, 1, 10, 0, 0, 500_000_000, time.UTC)
+	before := modified.Add(-time.Second).Format(http.TimeFormat)
+	same := modified.Format(http.TimeFormat) // loses the half second
+	after := modified.Add(time.Second).Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		lastModified time.Time
+		want         bool
+	}{
+		{"no validators", nil, modified, false},
+		{"matching etag", map[string]string{"If-None-Match": etag}, modified, true},
+		{"other etag", map[string]string{"If-None-Match": `W/"work-1-4"`}, modified, false},
+		{"modified since", map[string]string{"If-Modified-Since": before}, modified, false},
+		{"not modified since the same second", map[string]string{"If-Modified-Since": same}, modified, true},
+		{"not modified since later", map[string]string{"If-Modified-Since": after}, modified, true},
+		{"unparsable date", map[string]string{"If-Modified-Since": "yesterday"}, modified, false},
+		{"no last modified", map[string]string{"If-Modified-Since": after}, time.Time{}, false},
+		{"etag wins over the date", map[string]string{"If-None-Match": `W/"work-1-4"`, "If-Modified-Since": after}, modified, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/works/1", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "application/json")
+
+		got := notModified(w, r, etag, tt.lastModified)
+		if got != tt.want {
+			t.Errorf("%s: notModified = %v, want %v", tt.name, got, tt.want)
+		}
+		if got && w.Code != http.StatusNotModified {
+			t.Errorf("%s: status %d, want 304", tt.name, w.Code)
+		}
+		if got && w.Header().Get("Content-Type") != "" {
+			t.Errorf("%s: 304 kept the Content-Type", tt.name)
+		}
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("%s: ETag = %q, want %q", tt.name, w.Header().Get("ETag"), etag)
+		}
+		if lm := w.Header().Get("Last-Modified"); lm != "" && tt.lastModified.IsZero() {
+			t.Errorf("%s: Last-Modified %q set without a modification time", tt.name, lm)
+		} else if !tt.lastModified.IsZero() && lm != same {
+			t.Errorf("%s: Last-Modified = %q, want %q", tt.name, lm, same)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var contentTypes = []string{"text", "image"}
+
+var categorySlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// the largest upload limit a category can set, the request body may carry UPLOAD_MAX_FILES of them
+const maxCategoryUploadMB = 100
+
+// image_types and max_upload_mb restrict uploads to image categories, null allows every
+// format and the UPLOAD_MAX_MB size. pixelated images are scaled without smoothing
+type Category struct {
+	Slug           string   `json:"slug"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	ContentType    string   `json:"content_type"`
+	SortOrder      int      `json:"sort_order"`
+	ImageTypes     []string `json:"image_types"`
+	MaxUploadMB    *int     `json:"max_upload_mb"`
+	Pixelated      bool     `json:"pixelated"`
+	PublishedCount int      `json:"published_count"`
+}
+
+// the content type works of the category must have, sql.ErrNoRows when the category doesn't exist
+func categoryContentType(db *sql.DB, slug string) (string, error) {
+	var contentType string
+	err := db.QueryRow(`SELECT content_type FROM categories WHERE slug = $1`, slug).Scan(&contentType)
+	return contentType, err
+}
+
+// check that the category exists and holds works of the content type, writing the error response if not
+func validateCategory(db *sql.DB, w http.ResponseWriter, category, contentType string) bool {
+	categoryType, err := categoryContentType(db, category)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown category", http.StatusBadRequest)
+		return false
+	} else if err != nil {
+		http.Error(w, "Failed to fetch category: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if categoryType != contentType {
+		http.Error(w, "Category must be relevant to content type", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func validateCategoryFields(c Category) string {
+	if len(c.Slug) > 50 || !categorySlugPattern.MatchString(c.Slug) {
+		return "Slug must be lowercase letters, digits and dashes, at most 50 characters"
+	}
+	if c.Name == "" || len(c.Name) > 100 {
+		return "Name is required and at most 100 characters"
+	}
+	if c.ImageTypes != nil && len(c.ImageTypes) == 0 {
+		return "Image types must list at least one format, or be null to allow every format"
+	}
+	for _, t := range c.ImageTypes {
+		if _, ok := imageExtensions[t]; !ok {
+			return "Unsupported image type " + t
+		}
+	}
+	if c.MaxUploadMB != nil && (*c.MaxUploadMB < 1 || *c.MaxUploadMB > maxCategoryUploadMB) {
+		return fmt.Sprintf("Max upload size must be between 1 and %d MB", maxCategoryUploadMB)
+	}
+	for _, t := range contentTypes {
+		if c.ContentType == t {
+			return ""
+		}
+	}
+	return "Content type must be text or image"
+}
+
+// list categories in display order with how many published works each holds
+func getCategories(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT c.slug, c.name, c.description, c.content_type, c.sort_order, c.image_types, c.max_upload_mb, c.pixelated, COUNT(w.id)
+			FROM categories c
+			LEFT JOIN works w ON w.category = c.slug AND w.is_published = TRUE AND w.deleted_at IS NULL
+			GROUP BY c.slug
+			ORDER BY c.sort_order, c.name`)
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		categories := []Category{}
+		for rows.Next() {
+			var c Category
+			if err := rows.Scan(&c.Slug, &c.Name, &c.Description, &c.ContentType, &c.SortOrder,
+				pq.Array(&c.ImageTypes), &c.MaxUploadMB, &c.Pixelated, &c.PublishedCount); err != nil {
+				http.Error(w, "Error scanning categories: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			categories = append(categories, c)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(categories)
+	}
+}
+
+func createCategory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c Category
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if msg := validateCategoryFields(c); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO categories (slug, name, description, content_type, sort_order, image_types, max_upload_mb, pixelated)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			c.Slug, c.Name, c.Description, c.ContentType, c.SortOrder, pq.Array(c.ImageTypes), c.MaxUploadMB, c.Pixelated)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "A category with this slug already exists", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to create category: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// update a category, renaming the slug carries its works along
+func updateCategory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+
+		var c Category
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if msg := validateCategoryFields(c); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var currentType string
+		var currentPixelated bool
+		err = tx.QueryRow(`SELECT content_type, pixelated FROM categories WHERE slug = $1 FOR UPDATE`, slug).Scan(&currentType, &currentPixelated)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to fetch category: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// works can't change content type with their category
+		if c.ContentType != currentType {
+			var inUse bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM works WHERE category = $1)`, slug).Scan(&inUse); err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to check category works: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if inUse {
+				tx.Rollback()
+				http.Error(w, "The content type of a category with works can't be changed", http.StatusConflict)
+				return
+			}
+		}
+
+		_, err = tx.Exec(`
+			UPDATE categories SET slug = $1, name = $2, description = $3, content_type = $4, sort_order = $5,
+				image_types = $6, max_upload_mb = $7, pixelated = $8, updated_at = NOW()
+			WHERE slug = $9`,
+			c.Slug, c.Name, c.Description, c.ContentType, c.SortOrder, pq.Array(c.ImageTypes), c.MaxUploadMB, c.Pixelated, slug)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			tx.Rollback()
+			http.Error(w, "A category with this slug already exists", http.StatusConflict)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to update category: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// a new slug cascades to the works and pixelated changes how they render, neither touches
+		// updated_at, bump it so cached listings and works revalidate
+		if c.Slug != slug || c.Pixelated != currentPixelated {
+			if _, err := tx.Exec(`UPDATE works SET updated_at = NOW() WHERE category = $1`, c.Slug); err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to update category works: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// delete a category that no work uses
+func deleteCategory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+
+		res, err := db.Exec(`DELETE FROM categories WHERE slug = $1`, slug)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			http.Error(w, "The category still has works", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to delete category: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const usage = `usage:
+  api                          start the http server
+  api migrate up               apply all pending migrations
+  api migrate down [steps]     roll back the latest migrations (default 1)
+  api migrate status           list migrations and whether they are applied
+  api user create <username> <email> [role]
+                               create a user (admin by default), the password is read from stdin
+  api user passwd <username>   set a new password for a user
+  api user role <username> <role>
+                               set a user's role to admin, editor or viewer
+  api user list                list all users
+  api user delete <username>   delete a user
+  api storage fsck [--repair]  report stored files and image rows that don't match up,
+                               --repair moves, deletes and drops them`
+
+// dispatch a command line subcommand
+func runCommand(db *sql.DB, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(db, args[1:])
+	case "user":
+		if err := checkSchemaCurrent(db); err != nil {
+			return err
+		}
+		return runUser(db, args[1:])
+	case "storage":
+		if err := checkSchemaCurrent(db); err != nil {
+			return err
+		}
+		return runStorage(db, args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runMigrate(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp(db, os.Stdout)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return errors.New("steps must be a positive integer")
+			}
+			steps = n
+		}
+		return migrateDown(db, steps, os.Stdout)
+	case "status":
+		return migrationStatus(db, os.Stdout)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], usage)
+	}
+}
+
+func runUser(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) != 3 && len(args) != 4 {
+			return errors.New("usage: api user create <username> <email> [role]")
+		}
+		role := "admin"
+		if len(args) == 4 {
+			role = args[3]
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		id, err := createUser(db, args[1], args[2], password, role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created user %q with id %d\n", args[1], id)
+		return nil
+	case "passwd":
+		if len(args) != 2 {
+			return errors.New("usage: api user passwd <username>")
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		if _, err := setPassword(db, args[1], password); err != nil {
+			return err
+		}
+		fmt.Printf("updated password of %q\n", args[1])
+		return nil
+	case "role":
+		if len(args) != 3 {
+			return errors.New("usage: api user role <username> <role>")
+		}
+		if err := setRole(db, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("set role of %q to %s\n", args[1], args[2])
+		return nil
+	case "list":
+		return listUsers(db, os.Stdout)
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("usage: api user delete <username>")
+		}
+		if err := deleteUser(db, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("deleted user %q\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown user command %q\n%s", args[0], usage)
+	}
+}
+
+func runStorage(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "fsck":
+		repair := false
+		for _, arg := range args[1:] {
+			if arg != "--repair" {
+				return errors.New("usage: api storage fsck [--repair]")
+			}
+			repair = true
+		}
+		store, err := newStorage()
+		if err != nil {
+			return err
+		}
+		return storageFsck(context.Background(), db, store, repair, os.Stdout)
+	default:
+		return fmt.Errorf("unknown storage command %q\n%s", args[0], usage)
+	}
+}
+
+// prompt for a password twice on a terminal, or read a single line when stdin is piped
+func readNewPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("failed to read password from stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Print("password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("repeat password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(first), nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// uploads are stored without EXIF, XMP and similar metadata unless STRIP_IMAGE_METADATA=false.
+// the fields below are kept in the database, the orientation is kept in the file
+var stripImageMetadata = os.Getenv("STRIP_IMAGE_METADATA") != "false"
+
+// tags read from the EXIF of an uploaded photo
+type ImageExif struct {
+	Camera       string     `json:"camera,omitempty"`
+	Lens         string     `json:"lens,omitempty"`
+	ExposureTime string     `json:"exposure_time,omitempty"`
+	FNumber      float64    `json:"f_number,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focal_length,omitempty"`
+	TakenAt      *time.Time `json:"taken_at,omitempty"`
+	orientation  int
+}
+
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensMake         = 0xA433
+	tagLensModel        = 0xA434
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// parse the EXIF of a jpeg, png or webp file, nil when it has none
+func parseExif(data []byte, contentType string) *ImageExif {
+	raw := exifData(data, contentType)
+	if raw == nil {
+		return nil
+	}
+	t, ok := newTIFF(raw)
+	if !ok {
+		return nil
+	}
+
+	ifd0 := t.ifd(t.order.Uint32(raw[4:8]))
+	var exif ImageExif
+	exif.Camera = joinMake(t.ascii(ifd0[tagMake]), t.ascii(ifd0[tagModel]))
+	exif.orientation = int(t.number(ifd0[tagOrientation]))
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		sub := t.ifd(t.number(e))
+		exif.Lens = joinMake(t.ascii(sub[tagLensMake]), t.ascii(sub[tagLensModel]))
+		if num, den := t.rational(sub[tagExposureTime]); num > 0 && den > 0 {
+			if num < den {
+				exif.ExposureTime = fmt.Sprintf("1/%d", int(math.Round(float64(den)/float64(num))))
+			} else {
+				exif.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+			}
+		}
+		if num, den := t.rational(sub[tagFNumber]); den > 0 {
+			exif.FNumber = float64(num) / float64(den)
+		}
+		if num, den := t.rational(sub[tagFocalLength]); den > 0 {
+			exif.FocalLength = float64(num) / float64(den)
+		}
+		exif.ISO = int(t.number(sub[tagISO]))
+		// the camera's wall clock, EXIF rarely says which time zone that was
+		if takenAt, err := time.Parse("2006:01:02 15:04:05", t.ascii(sub[tagDateTimeOriginal])); err == nil {
+			exif.TakenAt = &takenAt
+		}
+	}
+	return &exif
+}
+
+// "Canon" and "Canon EOS R5" make "Canon EOS R5", not "Canon Canon EOS R5"
+func joinMake(maker, model string) string {
+	if maker == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		return model
+	}
+	return strings.TrimSpace(maker + " " + model)
+}
+
+// the TIFF structure holding the EXIF tags, found in a jpeg APP1 segment, a png eXIf chunk or a webp EXIF chunk
+func exifData(data []byte, contentType string) []byte {
+	var raw []byte
+	switch contentType {
+	case "image/jpeg":
+		walkJPEG(data, func(marker byte, segment []byte) bool {
+			if marker == 0xE1 && bytes.HasPrefix(segment[4:], exifHeader) {
+				raw = segment[4+len(exifHeader):]
+				return false
+			}
+			return true
+		})
+	case "image/png":
+		walkPNG(data, func(kind string, chunk []byte) bool {
+			if kind == "eXIf" {
+				raw = chunk[8 : len(chunk)-4]
+				return false
+			}
+			return true
+		})
+	case "image/webp":
+		walkWebP(data, func(kind string, chunk []byte) bool {
+			if kind == "EXIF" {
+				raw = bytes.TrimPrefix(chunk[8:8+binary.LittleEndian.Uint32(chunk[4:8])], exifHeader)
+				return false
+			}
+			return true
+		})
+	}
+	return raw
+}
+
+// drop EXIF, XMP and text metadata from the file. a jpeg's orientation survives in a
+// minimal EXIF segment so the photo still displays the right way up
+func stripMetadata(data []byte, contentType string, exif *ImageExif) []byte {
+	var out bytes.Buffer
+	switch contentType {
+	case "image/jpeg":
+		out.Write(data[:2])
+		if exif != nil && exif.orientation > 1 && exif.orientation <= 8 {
+			out.Write(orientationSegment(exif.orientation))
+		}
+		rest := walkJPEG(data, func(marker byte, segment []byte) bool {
+			// APP1 holds EXIF and XMP, APP13 holds photoshop and IPTC records
+			if marker != 0xE1 && marker != 0xED {
+				out.Write(segment)
+			}
+			return true
+		})
+		out.Write(data[rest:])
+	case "image/png":
+		out.Write(data[:8])
+		walkPNG(data, func(kind string, chunk []byte) bool {
+			if kind != "eXIf" && kind != "tEXt" && kind != "zTXt" && kind != "iTXt" {
+				out.Write(chunk)
+			}
+			return true
+		})
+	case "image/webp":
+		out.Write(data[:12])
+		walkWebP(data, func(kind string, chunk []byte) bool {
+			switch kind {
+			case "EXIF", "XMP ":
+				return true
+			case "VP8X":
+				// clear the flags announcing EXIF and XMP chunks
+				if len(chunk) > 8 {
+					chunk = bytes.Clone(chunk)
+					chunk[8] &^= 0x08 | 0x04
+				}
+			}
+			out.Write(chunk)
+			return true
+		})
+		stripped := out.Bytes()
+		binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	default:
+		return data
+	}
+	return out.Bytes()
+}
+
+// APP1 segment with an EXIF block holding nothing but the orientation
+func orientationSegment(orientation int) []byte {
+	segment := []byte{0xFF, 0xE1, 0, 34}
+	segment = append(segment, exifHeader...)
+	segment = append(segment, 'M', 'M', 0, 42, 0, 0, 0, 8) // big endian TIFF header, IFD0 at offset 8
+	segment = append(segment, 0, 1)                        // one entry
+	segment = append(segment, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0)
+	return append(segment, 0, 0, 0, 0) // no further IFDs
+}
+
+// call fn with every jpeg segment before the image data, marker and length included.
+// returns the offset where the segments end, so the caller can copy the remainder
+func walkJPEG(data []byte, fn func(marker byte, segment []byte) bool) int {
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xFF {
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA { // start of scan, entropy coded data follows
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		if !fn(marker, data[i:end]) {
+			return end
+		}
+		i = end
+	}
+	return i
+}
+
+// call fn with every png chunk, length, type and crc included
+func walkPNG(data []byte, fn func(kind string, chunk []byte) bool) {
+	for i := 8; i+12 <= len(data); {
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:i+4]))
+		if end > len(data) || end < i {
+			return
+		}
+		if !fn(string(data[i+4:i+8]), data[i:end]) {
+			return
+		}
+		i = end
+	}
+}
+
+// call fn with every webp chunk, header and padding included
+func walkWebP(data []byte, fn func(kind string, chunk []byte) bool) {
+	for i := 12; i+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		end := i + 8 + size + size%2
+		if end > len(data) || end < i {
+			return
+		}
+		if !fn(string(data[i:i+4]), data[i:end]) {
+			return
+		}
+		i = end
+	}
+}
+
+type tiffEntry struct {
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFF(data []byte) (tiff, bool) {
+	if len(data) < 8 {
+		return tiff{}, false
+	}
+	switch string(data[:2]) {
+	case "II":
+		return tiff{data, binary.LittleEndian}, true
+	case "MM":
+		return tiff{data, binary.BigEndian}, true
+	}
+	return tiff{}, false
+}
+
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// the entries of the IFD at offset, values that don't fit the entry are resolved to their offset
+func (t tiff) ifd(offset uint32) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return entries
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	for i := uint32(0); i < n; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(t.data)) {
+			break
+		}
+		e := t.data[start : start+12]
+		kind, count := t.order.Uint16(e[2:4]), t.order.Uint32(e[4:8])
+		size := uint64(tiffTypeSizes[kind]) * uint64(count)
+		if size == 0 {
+			continue
+		}
+
+		value := e[8:12]
+		if size > 4 {
+			at := uint64(t.order.Uint32(e[8:12]))
+			if at+size > uint64(len(t.data)) {
+				continue
+			}
+			value = t.data[at : at+size]
+		}
+		entries[t.order.Uint16(e[0:2])] = tiffEntry{kind, count, value[:min(size, uint64(len(value)))]}
+	}
+	return entries
+}
+
+func (t tiff) ascii(e tiffEntry) string {
+	if e.kind != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (t tiff) number(e tiffEntry) uint32 {
+	switch e.kind {
+	case 3:
+		return uint32(t.order.Uint16(e.value))
+	case 4:
+		return t.order.Uint32(e.value)
+	}
+	return 0
+}
+
+func (t tiff) rational(e tiffEntry) (uint32, uint32) {
+	if e.kind != 5 {
+		return 0, 0
+	}
+	return t.order.Uint32(e.value[0:4]), t.order.Uint32(e.value[4:8])
+}
+
+// turn an image the way its EXIF orientation says, so resized copies match how browsers show the original
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2:
+				dx = w - 1 - x
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dy = h - 1 - y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+const tagGPSIFD = 0x8825
+
+// builds a TIFF block the way cameras write it, values longer than four bytes go after the IFDs
+type tiffBuilder struct {
+	order tiffByteOrder
+}
+
+type tiffByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+type tiffField struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value []byte
+	sub   []tiffField // a nested IFD, the field's value becomes its offset
+}
+
+func (b tiffBuilder) ascii(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, kind: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func (b tiffBuilder) short(tag uint16, v uint16) tiffField {
+	return tiffField{tag: tag, kind: 3, count: 1, value: b.order.AppendUint16(nil, v)}
+}
+
+func (b tiffBuilder) rational(tag uint16, num, den uint32) tiffField {
+	return tiffField{tag: tag, kind: 5, count: 1, value: b.order.AppendUint32(b.order.AppendUint32(nil, num), den)}
+}
+
+func (b tiffBuilder) build(ifd0 []tiffField) []byte {
+	out := []byte("II*\x00")
+	if b.order.String() == binary.BigEndian.String() {
+		out = []byte("MM\x00*")
+	}
+	out = b.order.AppendUint32(out, 8)
+	var extra []byte
+	var write func(fields []tiffField, at int) []byte
+	// an IFD at offset at, with its overflow values placed at the end of the block
+	write = func(fields []tiffField, at int) []byte {
+		ifd := b.order.AppendUint16(nil, uint16(len(fields)))
+		end := at + 2 + 12*len(fields) + 4
+		var nested []byte
+		for _, f := range fields {
+			ifd = b.order.AppendUint16(ifd, f.tag)
+			if f.sub != nil {
+				ifd = b.order.AppendUint16(ifd, 4)
+				ifd = b.order.AppendUint32(ifd, 1)
+				ifd = b.order.AppendUint32(ifd, uint32(end+len(nested)))
+				nested = append(nested, write(f.sub, end+len(nested))...)
+				continue
+			}
+			ifd = b.order.AppendUint16(ifd, f.kind)
+			ifd = b.order.AppendUint32(ifd, f.count)
+			if len(f.value) <= 4 {
+				ifd = append(ifd, append(f.value, make([]byte, 4-len(f.value))...)...)
+			} else {
+				ifd = b.order.AppendUint32(ifd, uint32(0x1000+len(extra)))
+				extra = append(extra, f.value...)
+			}
+		}
+		ifd = b.order.AppendUint32(ifd, 0)
+		return append(ifd, nested...)
+	}
+	out = append(out, write(ifd0, 8)...)
+	// overflow values were given offsets from 0x1000, pad up to there
+	out = append(out, make([]byte, 0x1000-len(out))...)
+	return append(out, extra...)
+}
+
+// the tags of a phone photo taken somewhere it shouldn't reveal
+func cameraExif(order tiffByteOrder) []byte {
+	b := tiffBuilder{order}
+	return b.build([]tiffField{
+		b.ascii(tagMake, "Canon"),
+		b.ascii(tagModel, "Canon EOS R5"),
+		b.short(tagOrientation, 6),
+		{tag: tagExifIFD, sub: []tiffField{
+			b.rational(tagExposureTime, 1, 250),
+			b.rational(tagFNumber, 28, 10),
+			b.short(tagISO, 400),
+			b.ascii(tagDateTimeOriginal, "2024:05:01 10:30:00"),
+			b.rational(tagFocalLength, 50, 1),
+			b.ascii(tagLensMake, "Canon"),
+			b.ascii(tagLensModel, "RF50mm F1.8 STM"),
+		}},
+		{tag: tagGPSIFD, sub: []tiffField{
+			b.ascii(0x0001, "N"),
+			b.rational(0x0002, 52, 1),
+		}},
+	})
+}
+
+func testPicture() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 24, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 24; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 10), uint8(y * 15), 90, 255})
+		}
+	}
+	return img
+}
+
+// a jpeg with an EXIF APP1 segment right after SOI
+func jpegWithExif(t *testing.T, tiff []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testPicture(), nil); err != nil {
+		t.Fatal(err)
+	}
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	return append(append([]byte{0xFF, 0xD8}, segment...), buf.Bytes()[2:]...)
+}
+
+// a png with an eXIf chunk after IHDR
+func pngWithExif(t *testing.T, tiff []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testPicture()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(data[8:12]))
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(tiff)))
+	chunk = append(append(chunk, "eXIf"...), tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	return append(append(append([]byte{}, data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+}
+
+// an extended webp announcing and carrying an EXIF chunk after the image
+func webpWithExif(t *testing.T, tiff []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, testPicture(), nil); err != nil {
+		t.Fatal(err)
+	}
+	vp8l := buf.Bytes()[12:] // the image chunk
+
+	riffChunk := func(kind string, payload []byte) []byte {
+		c := binary.LittleEndian.AppendUint32([]byte(kind), uint32(len(payload)))
+		c = append(c, payload...)
+		if len(payload)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	vp8x := []byte{0x08, 0, 0, 0, 23, 0, 0, 15, 0, 0} // EXIF flag, canvas 24x16 stored minus one
+	body := append([]byte("WEBP"), riffChunk("VP8X", vp8x)...)
+	body = append(body, vp8l...)
+	body = append(body, riffChunk("EXIF", tiff)...)
+	return append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+}
+
+func TestParseExif(t *testing.T) {
+	takenAt := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	for _, order := range []tiffByteOrder{binary.LittleEndian, binary.BigEndian} {
+		tiff := cameraExif(order)
+		files := map[string][]byte{
+			"image/jpeg": jpegWithExif(t, tiff),
+			"image/png":  pngWithExif(t, tiff),
+			"image/webp": webpWithExif(t, tiff),
+		}
+		for contentType, data := range files {
+			exif := parseExif(data, contentType)
+			if exif == nil {
+				t.Fatalf("%s %v: no EXIF found", contentType, order)
+			}
+			if exif.Camera != "Canon EOS R5" || exif.Lens != "Canon RF50mm F1.8 STM" {
+				t.Errorf("%s %v: camera %q, lens %q", contentType, order, exif.Camera, exif.Lens)
+			}
+			if exif.ExposureTime != "1/250" || exif.FNumber != 2.8 || exif.ISO != 400 || exif.FocalLength != 50 {
+				t.Errorf("%s %v: exposure %s f/%g ISO %d %gmm", contentType, order, exif.ExposureTime, exif.FNumber, exif.ISO, exif.FocalLength)
+			}
+			if exif.TakenAt == nil || !exif.TakenAt.Equal(takenAt) {
+				t.Errorf("%s %v: taken at %v, want %v", contentType, order, exif.TakenAt, takenAt)
+			}
+			if exif.orientation != 6 {
+				t.Errorf("%s %v: orientation %d, want 6", contentType, order, exif.orientation)
+			}
+		}
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	tiff := cameraExif(binary.BigEndian)
+	files := map[string][]byte{
+		"image/jpeg": jpegWithExif(t, tiff),
+		"image/png":  pngWithExif(t, tiff),
+		"image/webp": webpWithExif(t, tiff),
+	}
+	for contentType, data := range files {
+		exif := parseExif(data, contentType)
+		stripped := stripMetadata(data, contentType, exif)
+
+		if raw := exifData(stripped, contentType); raw != nil {
+			tf, _ := newTIFF(raw)
+			ifd0 := tf.ifd(tf.order.Uint32(raw[4:8]))
+			if _, ok := ifd0[tagGPSIFD]; ok {
+				t.Errorf("%s: the GPS IFD pointer survived", contentType)
+			}
+			if _, ok := ifd0[tagMake]; ok {
+				t.Errorf("%s: the camera make survived", contentType)
+			}
+		}
+		if contentType == "image/jpeg" {
+			header := stripped[:walkJPEG(stripped, func(byte, []byte) bool { return true })]
+			if bytes.Contains(header, []byte{0x88, 0x25}) {
+				t.Errorf("%s: the GPS IFD tag 0x8825 survived in the segments", contentType)
+			}
+		}
+		if bytes.Contains(stripped, []byte("RF50mm")) {
+			t.Errorf("%s: the lens model survived", contentType)
+		}
+
+		// a jpeg keeps its orientation in a minimal segment, the other formats drop it
+		left := parseExif(stripped, contentType)
+		if contentType == "image/jpeg" {
+			if left == nil || left.orientation != 6 || left.Camera != "" {
+				t.Errorf("%s: stripped EXIF is %+v, want only orientation 6", contentType, left)
+			}
+		} else if left != nil {
+			t.Errorf("%s: stripped file still has EXIF %+v", contentType, left)
+		}
+
+		m, _, err := image.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			t.Errorf("%s: stripped file does not decode: %v", contentType, err)
+		} else if m.Bounds() != image.Rect(0, 0, 24, 16) {
+			t.Errorf("%s: stripped file decodes to %v", contentType, m.Bounds())
+		}
+	}
+
+	webp := stripMetadata(files["image/webp"], "image/webp", nil)
+	if webp[20]&0x08 != 0 {
+		t.Error("stripped webp still announces an EXIF chunk")
+	}
+	if size := binary.LittleEndian.Uint32(webp[4:8]); int(size) != len(webp)-8 {
+		t.Errorf("stripped webp RIFF size %d, want %d", size, len(webp)-8)
+	}
+}
+
+// malformed and truncated metadata must not crash the upload handler
+func TestMalformedExifDoesNotPanic(t *testing.T) {
+	valid := cameraExif(binary.LittleEndian)
+	tiffs := map[string][]byte{
+		"empty":                  {},
+		"header only":            valid[:8],
+		"ifd past the end":       append([]byte("II*\x00"), 0xFF, 0xFF, 0, 0),
+		"huge entry count":       append([]byte("II*\x00\x08\x00\x00\x00"), 0xFF, 0xFF),
+		"value offset past end":  append([]byte("II*\x00\x08\x00\x00\x00\x01\x00\x0F\x01\x02\x00\x20\x00\x00\x00\xF0\xFF\x00\x00"), 0, 0, 0, 0),
+		"exif ifd past the end":  append([]byte("II*\x00\x08\x00\x00\x00\x01\x00\x69\x87\x04\x00\x01\x00\x00\x00\xF0\xFF\x00\x00"), 0, 0, 0, 0),
+		"truncated camera block": valid[:len(valid)/2],
+		"bad byte order":         append([]byte("XX*\x00"), valid[4:]...),
+	}
+	for name, tiff := range tiffs {
+		for contentType, data := range map[string][]byte{
+			"image/jpeg": jpegWithExif(t, tiff),
+			"image/png":  pngWithExif(t, tiff),
+			"image/webp": webpWithExif(t, tiff),
+		} {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%s %s: panic %v", name, contentType, r)
+					}
+				}()
+				stripMetadata(data, contentType, parseExif(data, contentType))
+			}()
+		}
+	}
+
+	// every truncation of a file down to the shortest one content sniffing accepts, which
+	// also cuts segment and chunk lengths short
+	for contentType, file := range map[string]struct {
+		data     []byte
+		shortest int
+	}{
+		"image/jpeg": {jpegWithExif(t, valid), 3},
+		"image/png":  {pngWithExif(t, valid), 8},
+		"image/webp": {webpWithExif(t, valid), 14},
+	} {
+		for n := file.shortest; n < len(file.data); n++ {
+			data := file.data[:n]
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s cut to %d bytes: panic %v", contentType, n, r)
+					}
+				}()
+				stripMetadata(data, contentType, parseExif(data, contentType))
+			}()
+		}
+	}
+
+	// an APP1 segment whose length runs past the end of the file
+	broken := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xF0, 'E', 'x', 'i', 'f', 0, 0, 'I', 'I'}
+	if exif := parseExif(broken, "image/jpeg"); exif != nil {
+		t.Errorf("parsed %+v from a segment running past the end", exif)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// keys of content addressed files, the hex sha-256 of the content and an extension
+var contentKeyPattern = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z]+$`)
+
+// store data under the sha-256 of its content unless a file with that content is already
+// stored, and return its key. the stored_files row is locked so a concurrent
+// deleteUnreferencedFiles can't remove the file before the caller's rows refer to it
+func putFile(ctx context.Context, tx *sql.Tx, store Storage, data []byte, contentType string) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:]) + imageExtensions[contentType]
+
+	var exists int
+	err := tx.QueryRow(`SELECT 1 FROM stored_files WHERE key = $1 FOR SHARE`, key).Scan(&exists)
+	if err == nil {
+		return key, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if err := store.Put(ctx, key, bytes.NewReader(data), contentType); err != nil {
+		return "", err
+	}
+	// the reference count is raised by the triggers once the caller records the file
+	_, err = tx.Exec(`
+		INSERT INTO stored_files (key, content_type, size) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO NOTHING`, key, contentType, len(data))
+	return key, err
+}
+
+// the sha-256 of a content addressed key, "" for keys named before files were content addressed
+func contentHash(key string) string {
+	if !contentKeyPattern.MatchString(key) {
+		return ""
+	}
+	return key[:strings.IndexByte(key, '.')]
+}
+
+// remove the files among keys that nothing refers to anymore. the rows stay locked until the
+// files are gone, so an upload of the same content waits and then stores it again
+func deleteUnreferencedFiles(ctx context.Context, db *sql.DB, store Storage, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to delete unreferenced files: %s", err.Error())
+		return
+	}
+
+	rows, err := tx.Query(`DELETE FROM stored_files WHERE key = ANY($1) AND ref_count <= 0 RETURNING key`, pq.Array(keys))
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Failed to delete unreferenced files: %s", err.Error())
+		return
+	}
+	var unreferenced []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			tx.Rollback()
+			log.Printf("Failed to delete unreferenced files: %s", err.Error())
+			return
+		}
+		unreferenced = append(unreferenced, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		log.Printf("Failed to delete unreferenced files: %s", err.Error())
+		return
+	}
+
+	// files that fail to delete are orphans from here on, fsck finds them
+	deleteFiles(ctx, store, unreferenced)
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to delete unreferenced files: %s", err.Error())
+	}
+}
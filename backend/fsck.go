@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+// files younger than this may belong to a request that hasn't committed yet and are left alone
+const fsckGracePeriod = time.Hour
+
+// compare storage with the database. staged files whose rows committed are moved into place,
+// files nothing refers to are orphans, rows whose file is missing are dangling and reference
+// counts that don't match the rows are corrected. problems are only reported unless repair is set
+func storageFsck(ctx context.Context, db *sql.DB, store Storage, repair bool, out io.Writer) error {
+	// rows are read before listing so rows committed in between can't look dangling, and a
+	// file stored in between is young enough to be skipped
+	referenced, err := referencedFiles(db)
+	if err != nil {
+		return err
+	}
+	variants, err := queryFileRows(db, `SELECT id, image_id, path FROM image_variants ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	images, err := queryFileRows(db, `SELECT id, work_id, image_path FROM images ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	revisions, err := queryFileRows(db, `SELECT r.revision, r.work_id, f FROM work_revisions r, unnest(r.files) f ORDER BY r.work_id, r.revision`)
+	if err != nil {
+		return err
+	}
+	refCounts, err := storedRefCounts(db)
+	if err != nil {
+		return err
+	}
+	objects, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	// several requests may have staged the same key, each under its own directory
+	stored, staged := map[string]StoredObject{}, map[string][]StoredObject{}
+	for _, o := range objects {
+		if key, ok := stagedKey(o.Key); ok {
+			staged[key] = append(staged[key], o)
+		} else {
+			stored[o.Key] = o
+		}
+	}
+
+	problems := 0
+	report := func(format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(out, format+"\n", args...)
+	}
+	failed := func(action string, err error) {
+		fmt.Fprintf(out, "  failed to %s: %s\n", action, err.Error())
+	}
+	old := func(o StoredObject) bool {
+		return time.Since(o.ModTime) > fsckGracePeriod
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(staged)) {
+		for _, o := range staged[key] {
+			_, isStored := stored[key]
+			switch {
+			case referenced[key] > 0 && !isStored:
+				report("unmoved staged file %s", o.Key)
+				if repair {
+					if err := store.Rename(ctx, o.Key, key); err != nil {
+						failed("move it into place", err)
+						continue
+					}
+					stored[key] = StoredObject{Key: key, Size: o.Size, ModTime: o.ModTime}
+				}
+			case old(o):
+				report("leftover staged file %s", o.Key)
+				if repair {
+					if err := store.Delete(ctx, o.Key); err != nil {
+						failed("delete it", err)
+					}
+				}
+			}
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(stored)) {
+		if referenced[key] == 0 && old(stored[key]) {
+			report("orphaned file %s", key)
+			if repair {
+				deleted, err := deleteOrphanedFile(ctx, db, store, key)
+				if err != nil {
+					failed("delete it", err)
+				} else if !deleted {
+					fmt.Fprintln(out, "  kept, it is referenced again")
+				}
+			}
+		}
+	}
+
+	// the triggers keep the counts, a mismatch means they were bypassed or the rows edited by hand
+	for _, key := range slices.Sorted(maps.Keys(referenced)) {
+		count, ok := refCounts[key]
+		if ok && count == referenced[key] {
+			continue
+		}
+		report("reference count of %s is %d, %d rows refer to it", key, count, referenced[key])
+		if repair {
+			_, err := db.Exec(`
+				INSERT INTO stored_files (key, ref_count) VALUES ($1, $2)
+				ON CONFLICT (key) DO UPDATE SET ref_count = EXCLUDED.ref_count`, key, referenced[key])
+			if err != nil {
+				failed("correct it", err)
+			}
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(refCounts)) {
+		if referenced[key] == 0 && refCounts[key] != 0 {
+			report("reference count of %s is %d, no rows refer to it", key, refCounts[key])
+			if repair {
+				if _, err := db.Exec(`UPDATE stored_files SET ref_count = 0 WHERE key = $1`, key); err != nil {
+					failed("correct it", err)
+				}
+			}
+		}
+	}
+
+	// a file still waiting in the staging area was reported above
+	missing := func(key string) bool {
+		_, isStored := stored[key]
+		_, isStaged := staged[key]
+		return !isStored && !isStaged
+	}
+	for _, v := range variants {
+		if missing(v.key) {
+			report("variant %d of image %d points at missing file %s", v.id, v.owner, v.key)
+			if repair {
+				if _, err := db.Exec(`DELETE FROM image_variants WHERE id = $1`, v.id); err != nil {
+					failed("delete the row", err)
+				}
+			}
+		}
+	}
+	for _, img := range images {
+		if missing(img.key) {
+			report("image %d of work %d points at missing file %s", img.id, img.owner, img.key)
+			if repair {
+				if _, err := db.Exec(`DELETE FROM images WHERE id = $1`, img.id); err != nil {
+					failed("delete the row", err)
+				}
+			}
+		}
+	}
+
+	// revisions are history, a missing file is reported but the revision kept
+	for _, rev := range revisions {
+		if missing(rev.key) {
+			report("revision %d of work %d refers to missing file %s", rev.id, rev.owner, rev.key)
+		}
+	}
+
+	switch {
+	case problems == 0:
+		fmt.Fprintln(out, "storage is consistent with the database")
+	case repair:
+		fmt.Fprintf(out, "%d problems found, repairs attempted where possible\n", problems)
+	default:
+		fmt.Fprintf(out, "%d problems found, run with --repair to fix them\n", problems)
+	}
+	return nil
+}
+
+// delete an orphaned file unless something referred to it since the scan. like
+// deleteUnreferencedFiles the row stays locked until the file is gone, a file without a row
+// gets one first so a concurrent upload of the same content waits for the delete
+func deleteOrphanedFile(ctx context.Context, db *sql.DB, store Storage, key string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO stored_files (key) VALUES ($1) ON CONFLICT (key) DO NOTHING`, key); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var deleted string
+	err = tx.QueryRow(`DELETE FROM stored_files WHERE key = $1 AND ref_count <= 0 RETURNING key`, key).Scan(&deleted)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return false, nil
+	} else if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// how many images, variants and revision entries refer to each storage key
+func referencedFiles(db *sql.DB) (map[string]int, error) {
+	return queryKeyCounts(db, `
+		SELECT key, COUNT(*) FROM (
+			SELECT image_path AS key FROM images
+			UNION ALL SELECT path FROM image_variants
+			UNION ALL SELECT unnest(files) FROM work_revisions
+		) refs
+		GROUP BY key`)
+}
+
+// the reference counts kept in stored_files
+func storedRefCounts(db *sql.DB) (map[string]int, error) {
+	return queryKeyCounts(db, `SELECT key, ref_count FROM stored_files`)
+}
+
+func queryKeyCounts(db *sql.DB, query string) (map[string]int, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		counts[key] = count
+	}
+	return counts, rows.Err()
+}
+
+// a row referring to a stored file, owner is the image or work the row belongs to
+type fileRow struct {
+	id, owner int
+	key       string
+}
+
+func queryFileRows(db *sql.DB, query string) ([]fileRow, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []fileRow
+	for rows.Next() {
+		var row fileRow
+		if err := rows.Scan(&row.id, &row.owner, &row.key); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
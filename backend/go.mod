@@ -3,8 +3,13 @@ module api
 go 1.23.2
 
 require (
+	github.com/HugoSmits86/nativewebp v1.1.4
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/mux v1.8.1
 	github.com/lib/pq v1.10.9
 	golang.org/x/crypto v0.29.0
+	golang.org/x/image v0.24.0
+	golang.org/x/term v0.26.0
 )
+
+require golang.org/x/sys v0.27.0 // indirect
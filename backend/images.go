@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// one of the ordered images of a work
+type WorkImage struct {
+	Id       int            `json:"id"`
+	URL      string         `json:"url"`
+	Caption  string         `json:"caption"`
+	Alt      string         `json:"alt"`
+	Position int            `json:"position"`
+	Variants []ImageVariant `json:"variants,omitempty"`
+	Exif     *ImageExif     `json:"exif,omitempty"`
+	path     string
+}
+
+// an uploaded image written to storage, waiting to be recorded in the images table
+type storedImage struct {
+	key      string
+	caption  string
+	alt      string
+	exif     *ImageExif
+	variants []ImageVariant
+}
+
+// store a validated upload and its resized variants under their content hashes. EXIF is read
+// before metadata is stripped so the interesting fields can still be kept in the database.
+// on error the caller's staged store removes whatever was written
+func storeImage(ctx context.Context, tx *sql.Tx, store Storage, file io.Reader, contentType string, pixelated bool) (*storedImage, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &storedImage{exif: parseExif(data, contentType)}
+	if stripImageMetadata {
+		data = stripMetadata(data, contentType, img.exif)
+	}
+
+	orientation := 0
+	if img.exif != nil {
+		orientation = img.exif.orientation
+	}
+	// decoding first keeps undecodable uploads out of storage
+	img.variants, err = generateVariants(data, contentType, pixelated, orientation)
+	if err != nil {
+		return nil, err
+	}
+
+	if img.key, err = putFile(ctx, tx, store, data, contentType); err != nil {
+		return nil, err
+	}
+	for i := range img.variants {
+		v := &img.variants[i]
+		if v.path, err = putFile(ctx, tx, store, v.data, v.ContentType); err != nil {
+			return nil, err
+		}
+		v.data = nil
+	}
+	return img, nil
+}
+
+// undecodable uploads are the client's fault, storage failures are ours
+func imageErrorStatus(err error) int {
+	if errors.Is(err, errInvalidImage) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// validate, store and record every file of the "file" form field after the work's existing
+// images, captions and alt texts are matched to the files by position. on failure the
+// response is written, the caller rolls back the transaction and its staged files
+func saveUploadedImages(w http.ResponseWriter, r *http.Request, tx *sql.Tx, store *stagedStore, workID interface{}, rules *uploadRules) bool {
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		http.Error(w, "Failed to read uploaded file: "+http.ErrMissingFile.Error(), http.StatusBadRequest)
+		return false
+	}
+	if len(files) > maxUploadFiles {
+		writeUploadError(w, &uploadError{
+			status:  http.StatusRequestEntityTooLarge,
+			Code:    "too_many_files",
+			Message: fmt.Sprintf("At most %d files can be uploaded at once", maxUploadFiles),
+		})
+		return false
+	}
+	captions, alts := r.MultipartForm.Value["caption"], r.MultipartForm.Value["alt"]
+
+	for i, header := range files {
+		file, err := header.Open()
+		if err != nil {
+			http.Error(w, "Failed to read uploaded file: "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+
+		fileType, uploadErr := validateUpload(file, header, rules)
+		if uploadErr != nil {
+			file.Close()
+			writeUploadError(w, uploadErr)
+			return false
+		}
+
+		img, err := storeImage(r.Context(), tx, store, file, fileType, rules.pixelated)
+		file.Close()
+		if err != nil {
+			http.Error(w, "Failed to save file: "+err.Error(), imageErrorStatus(err))
+			return false
+		}
+
+		if i < len(captions) {
+			img.caption = captions[i]
+		}
+		if i < len(alts) {
+			img.alt = alts[i]
+		}
+		if _, err := insertImage(tx, workID, img); err != nil {
+			http.Error(w, "Failed to save image metadata: "+err.Error(), http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// EXIF columns of the images table, NULL where the photo didn't say
+func exifValues(exif *ImageExif) []interface{} {
+	if exif == nil {
+		exif = &ImageExif{}
+	}
+	return []interface{}{
+		sql.NullString{String: exif.Camera, Valid: exif.Camera != ""},
+		sql.NullString{String: exif.Lens, Valid: exif.Lens != ""},
+		sql.NullString{String: exif.ExposureTime, Valid: exif.ExposureTime != ""},
+		sql.NullFloat64{Float64: exif.FNumber, Valid: exif.FNumber != 0},
+		sql.NullInt64{Int64: int64(exif.ISO), Valid: exif.ISO != 0},
+		sql.NullFloat64{Float64: exif.FocalLength, Valid: exif.FocalLength != 0},
+		exif.TakenAt,
+	}
+}
+
+// record a stored image after the work's other images, along with its EXIF fields and variants
+func insertImage(tx *sql.Tx, workID interface{}, img *storedImage) (int, error) {
+	var imageID int
+	args := append([]interface{}{workID, img.key, img.key, img.caption, img.alt}, exifValues(img.exif)...)
+	err := tx.QueryRow(`
+		INSERT INTO images (work_id, image_path, image_name, caption, alt_text, position,
+			camera, lens, exposure_time, f_number, iso, focal_length, taken_at)
+		VALUES ($1, $2, $3, $4, $5, (SELECT COALESCE(MAX(position), -1) + 1 FROM images WHERE work_id = $1),
+			$6, $7, $8, $9, $10, $11, $12)
+		RETURNING id`, args...).Scan(&imageID)
+	if err != nil {
+		return 0, err
+	}
+	return imageID, saveVariants(tx, imageID, img.variants)
+}
+
+// point an existing images row at a newly stored image, replacing its EXIF fields and variants
+func replaceImage(tx *sql.Tx, imageID int, img *storedImage) error {
+	args := append([]interface{}{imageID, img.key, img.key}, exifValues(img.exif)...)
+	_, err := tx.Exec(`
+		UPDATE images SET image_path = $2, image_name = $3, camera = $4, lens = $5, exposure_time = $6,
+			f_number = $7, iso = $8, focal_length = $9, taken_at = $10
+		WHERE id = $1`, args...)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM image_variants WHERE image_id = $1`, imageID); err != nil {
+		return err
+	}
+	return saveVariants(tx, imageID, img.variants)
+}
+
+// storage keys of the images matching cond and of their variants, cond filters images i
+func imageFiles(tx *sql.Tx, cond string, arg interface{}) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT i.image_path FROM images i WHERE `+cond+`
+		UNION ALL
+		SELECT v.path FROM image_variants v JOIN images i ON i.id = v.image_id WHERE `+cond, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// a *sql.DB or a *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// fill in the images of the image works among works, the first one is also the work's image_url
+func attachImages(db queryer, store Storage, works []Work) error {
+	byID := map[int]*Work{}
+	var ids []int64
+	for i := range works {
+		if works[i].ContentType == "image" {
+			byID[works[i].Id] = &works[i]
+			ids = append(ids, int64(works[i].Id))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(`
+		SELECT id, work_id, image_path, position, caption, alt_text,
+			camera, lens, exposure_time, f_number, iso, focal_length, taken_at
+		FROM images
+		WHERE work_id = ANY($1)
+		ORDER BY work_id, position, id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var imageIDs []int64
+	for rows.Next() {
+		var workID int
+		var image WorkImage
+		var camera, lens, exposureTime sql.NullString
+		var fNumber, focalLength sql.NullFloat64
+		var iso sql.NullInt64
+		var takenAt sql.NullTime
+		if err := rows.Scan(&image.Id, &workID, &image.path, &image.Position, &image.Caption, &image.Alt,
+			&camera, &lens, &exposureTime, &fNumber, &iso, &focalLength, &takenAt); err != nil {
+			return err
+		}
+		image.URL = store.URL(image.path)
+
+		exif := ImageExif{
+			Camera:       camera.String,
+			Lens:         lens.String,
+			ExposureTime: exposureTime.String,
+			FNumber:      fNumber.Float64,
+			ISO:          int(iso.Int64),
+			FocalLength:  focalLength.Float64,
+		}
+		if takenAt.Valid {
+			exif.TakenAt = &takenAt.Time
+		}
+		if exif != (ImageExif{}) {
+			image.Exif = &exif
+		}
+
+		work := byID[workID]
+		if len(work.Images) == 0 {
+			work.ImagePath, work.ImageName, work.ImageURL = &image.path, &image.path, &image.URL
+		}
+		work.Images = append(work.Images, image)
+		imageIDs = append(imageIDs, int64(image.Id))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the images slices are complete, pointers into them stay valid
+	byImage := map[int]*WorkImage{}
+	for _, work := range byID {
+		for i := range work.Images {
+			byImage[work.Images[i].Id] = &work.Images[i]
+		}
+	}
+
+	variantRows, err := db.Query(`
+		SELECT v.image_id, v.size, v.content_type, v.path, v.width, v.height, COALESCE(f.size, 0)
+		FROM image_variants v
+		LEFT JOIN stored_files f ON f.key = v.path
+		WHERE v.image_id = ANY($1)
+		ORDER BY v.width, v.content_type`, pq.Array(imageIDs))
+	if err != nil {
+		return err
+	}
+	defer variantRows.Close()
+
+	for variantRows.Next() {
+		var imageID int
+		var v ImageVariant
+		if err := variantRows.Scan(&imageID, &v.Size, &v.ContentType, &v.path, &v.Width, &v.Height, &v.Bytes); err != nil {
+			return err
+		}
+		v.URL = store.URL(v.path)
+		image := byImage[imageID]
+		image.Variants = append(image.Variants, v)
+	}
+	return variantRows.Err()
+}
+
+// respond with the current images of a work
+func writeWorkImages(w http.ResponseWriter, db *sql.DB, store Storage, id string, status int) {
+	workID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "Invalid work id", http.StatusBadRequest)
+		return
+	}
+	works := []Work{{Id: workID, ContentType: "image"}}
+	if err := attachImages(db, store, works); err != nil {
+		http.Error(w, "Error retrieving work images: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if works[0].Images == nil {
+		works[0].Images = []WorkImage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(works[0].Images)
+}
+
+// lock the images of a work and return their ids in order
+func lockWorkImages(tx *sql.Tx, id string) ([]int, error) {
+	rows, err := tx.Query(`SELECT id FROM images WHERE work_id = $1 ORDER BY position, id FOR UPDATE`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var imageID int
+		if err := rows.Scan(&imageID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, imageID)
+	}
+	return ids, rows.Err()
+}
+
+// add images to the end of an image work
+func addWorkImages(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+
+		var contentType, category string
+		err := db.QueryRow(`SELECT content_type, category FROM works WHERE id = $1`, id).Scan(&contentType, &category)
+		if err != nil {
+			http.Error(w, "Failed to fetch work details: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if contentType != "image" {
+			http.Error(w, "Only image works have images", http.StatusBadRequest)
+			return
+		}
+
+		rules, err := categoryUploadRules(db, category)
+		if err != nil {
+			http.Error(w, "Failed to fetch category: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !parseUploadForm(db, w, r) {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := beginRevision(tx, store, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the files only move into place once the rows pointing at them are committed
+		staged := stageWrites(store)
+		defer staged.rollback(r.Context())
+
+		if !saveUploadedImages(w, r, tx, staged, id, rules) {
+			tx.Rollback()
+			return
+		}
+
+		if _, err := tx.Exec(`UPDATE works SET updated_at = NOW() WHERE id = $1`, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to update work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := recordRevision(tx, store, id, currentUser(r), nil); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		staged.commit(r.Context())
+
+		writeWorkImages(w, db, store, id, http.StatusCreated)
+	}
+}
+
+// change the caption or alt text of an image
+func updateWorkImage(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+
+		var req struct {
+			Caption *string `json:"caption"`
+			Alt     *string `json:"alt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := beginRevision(tx, store, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res, err := tx.Exec(`
+			UPDATE images SET caption = COALESCE($1, caption), alt_text = COALESCE($2, alt_text)
+			WHERE id = $3 AND work_id = $4`, req.Caption, req.Alt, vars["imageId"], id)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to update image: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			tx.Rollback()
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+
+		if _, err := tx.Exec(`UPDATE works SET updated_at = NOW() WHERE id = $1`, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to update work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := recordRevision(tx, store, id, currentUser(r), nil); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeWorkImages(w, db, store, id, http.StatusOK)
+	}
+}
+
+// put the images of a work in the order of the given ids, which must name every image exactly once
+func reorderWorkImages(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+
+		var req struct {
+			Order []int `json:"order"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := beginRevision(tx, store, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		current, err := lockWorkImages(tx, id)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to fetch images: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		remaining := map[int]bool{}
+		for _, imageID := range current {
+			remaining[imageID] = true
+		}
+		for _, imageID := range req.Order {
+			if !remaining[imageID] {
+				tx.Rollback()
+				http.Error(w, fmt.Sprintf("Image %d is not part of this work or is listed twice", imageID), http.StatusBadRequest)
+				return
+			}
+			delete(remaining, imageID)
+		}
+		if len(remaining) > 0 {
+			tx.Rollback()
+			http.Error(w, "The order must list every image of the work", http.StatusBadRequest)
+			return
+		}
+
+		for position, imageID := range req.Order {
+			if _, err := tx.Exec(`UPDATE images SET position = $1 WHERE id = $2`, position, imageID); err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to reorder images: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if _, err := tx.Exec(`UPDATE works SET updated_at = NOW() WHERE id = $1`, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to update work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := recordRevision(tx, store, id, currentUser(r), nil); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeWorkImages(w, db, store, id, http.StatusOK)
+	}
+}
+
+// remove an image from a work, an image work keeps at least one
+func deleteWorkImage(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id := vars["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+
+		imageID, err := strconv.Atoi(vars["imageId"])
+		if err != nil {
+			http.Error(w, "Invalid image id", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := beginRevision(tx, store, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		current, err := lockWorkImages(tx, id)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to fetch images: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !slices.Contains(current, imageID) {
+			tx.Rollback()
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		if len(current) == 1 {
+			tx.Rollback()
+			http.Error(w, "An image work needs at least one image", http.StatusConflict)
+			return
+		}
+
+		files, err := imageFiles(tx, "i.id = $1", imageID)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM images WHERE id = $1`, imageID)
+		}
+		if err == nil {
+			_, err = tx.Exec(`UPDATE works SET updated_at = NOW() WHERE id = $1`, id)
+		}
+		if err == nil {
+			_, err = recordRevision(tx, store, id, currentUser(r), nil)
+		}
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to delete image: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the files stay in storage while a revision refers to the image
+		deleteUnreferencedFiles(r.Context(), db, store, files)
+		writeWorkImages(w, db, store, id, http.StatusOK)
+	}
+}
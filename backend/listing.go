@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	cursorTimeLayout = "2006-01-02T15:04:05.999999"
+)
+
+// sortable columns of the works listings and the sql type their cursor value is cast to
+var workSortColumns = map[string]string{
+	"created_at": "timestamp",
+	"updated_at": "timestamp",
+	"title":      "text",
+}
+
+// page of works returned by the listing endpoints
+type WorkPage struct {
+	Works      []Work `json:"works"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// position after the last row of a page, handed to clients as an opaque string
+type workCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	Id    int    `json:"id"`
+}
+
+type workListParams struct {
+	limit  int
+	offset int
+	sort   string
+	desc   bool
+	cursor *workCursor
+}
+
+// sql conditions joined with AND, "?" placeholders are numbered in the order they are added
+type workFilter struct {
+	conds []string
+	args  []interface{}
+}
+
+func (f *workFilter) add(cond string, args ...interface{}) {
+	for _, arg := range args {
+		f.args = append(f.args, arg)
+		cond = strings.Replace(cond, "?", fmt.Sprintf("$%d", len(f.args)), 1)
+	}
+	f.conds = append(f.conds, cond)
+}
+
+func (f *workFilter) where() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.conds, " AND ")
+}
+
+func encodeCursor(c workCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*workCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var c workCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// parse limit, offset, cursor, sort and order query parameters
+func parseWorkListParams(r *http.Request) (workListParams, error) {
+	q := r.URL.Query()
+	p := workListParams{limit: defaultPageLimit, sort: "created_at", desc: true}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return p, errors.New("limit must be a positive integer")
+		}
+		p.limit = min(limit, maxPageLimit)
+	}
+
+	if v := q.Get("sort"); v != "" {
+		if _, ok := workSortColumns[v]; !ok {
+			return p, errors.New("sort must be one of created_at, updated_at, title")
+		}
+		p.sort = v
+	}
+
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		p.desc = false
+	case "desc":
+		p.desc = true
+	default:
+		return p, errors.New("order must be asc or desc")
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return p, errors.New("offset must be a non-negative integer")
+		}
+		p.offset = offset
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		if p.offset > 0 {
+			return p, errors.New("cursor and offset cannot be combined")
+		}
+		c, err := decodeCursor(v)
+		if err != nil {
+			return p, err
+		}
+		if c.Sort != p.sort || c.Desc != p.desc {
+			return p, errors.New("cursor does not match sort order")
+		}
+		p.cursor = c
+	}
+
+	return p, nil
+}
+
+// query one page of works matching the filter, along with the total count
+func queryWorkPage(db *sql.DB, filter workFilter, p workListParams) (WorkPage, error) {
+	page := WorkPage{Works: []Work{}}
+
+	if err := db.QueryRow(`SELECT COUNT(*) FROM works`+filter.where(), filter.args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	direction, comparison := "ASC", ">"
+	if p.desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	if p.cursor != nil {
+		filter.add(fmt.Sprintf("(%s, id) %s (?::%s, ?)", p.sort, comparison, workSortColumns[p.sort]),
+			p.cursor.Value, p.cursor.Id)
+	}
+
+	query := `SELECT id, title, author, content_type, category, created_at, updated_at, is_published, publish_at, published_at, deleted_at FROM works` +
+		filter.where() +
+		fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %d OFFSET %d", p.sort, direction, direction, p.limit+1, p.offset)
+
+	rows, err := db.Query(query, filter.args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var work Work
+		if err := rows.Scan(&work.Id, &work.Title, &work.Author, &work.ContentType, &work.Category,
+			&work.CreatedAt, &work.UpdatedAt, &work.IsPublished, &work.PublishAt, &work.PublishedAt, &work.DeletedAt); err != nil {
+			return page, err
+		}
+		page.Works = append(page.Works, work)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	// one extra row was fetched to know whether another page follows
+	if len(page.Works) > p.limit {
+		page.Works = page.Works[:p.limit]
+		last := page.Works[len(page.Works)-1]
+		page.NextCursor = encodeCursor(workCursor{
+			Sort:  p.sort,
+			Desc:  p.desc,
+			Value: workSortValue(last, p.sort),
+			Id:    last.Id,
+		})
+	}
+
+	return page, nil
+}
+
+func workSortValue(work Work, sort string) string {
+	switch sort {
+	case "updated_at":
+		return work.UpdatedAt.Format(cursorTimeLayout)
+	case "title":
+		return work.Title
+	default:
+		return work.CreatedAt.Format(cursorTimeLayout)
+	}
+}
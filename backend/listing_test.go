@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []workCursor{
+		{Sort: "created_at", Desc: true, Value: "2024-05-01T10:00:00.123456Z", Id: 42},
+		{Sort: "title", Desc: false, Value: "ümlaut, \"quotes\" & commas", Id: 1},
+		{Sort: "title", Value: "", Id: 0},
+	}
+	for _, c := range tests {
+		encoded := encodeCursor(c)
+		got, err := decodeCursor(encoded)
+		if err != nil {
+			t.Errorf("decodeCursor(encodeCursor(%+v)): %v", c, err)
+			continue
+		}
+		if *got != c {
+			t.Errorf("decodeCursor(encodeCursor(%+v)) = %+v", c, *got)
+		}
+	}
+}
+
+func TestDecodeCursorRejectsGarbage(t *testing.T) {
+	tests := map[string]string{
+		"not base64":       "%%%",
+		"padded base64":    base64.URLEncoding.EncodeToString([]byte(`{"s":"title"}`)),
+		"not json":         base64.RawURLEncoding.EncodeToString([]byte("title:1")),
+		"wrong field type": base64.RawURLEncoding.EncodeToString([]byte(`{"id":"1"}`)),
+	}
+	for name, cursor := range tests {
+		if c, err := decodeCursor(cursor); err == nil {
+			t.Errorf("%s: decodeCursor(%q) = %+v, want an error", name, cursor, *c)
+		}
+	}
+}
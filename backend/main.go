@@ -3,20 +3,14 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
-	"time"
-
-	"errors"
 	"strings"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -27,22 +21,29 @@ type User struct {
 	Username  string `json:"username"`
 	Email     string `json:"email"`
 	Password  string `json:"password"`
+	Role      string `json:"role"`
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at"`
 }
 
 type Work struct {
-	Id          int       `json:"id"`
-	Title       string    `json:"title"`
-	Author      string    `json:"author"`
-	ContentType string    `json:"content_type"`
-	Category    string    `json:"category"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	IsPublished bool      `json:"is_published"`
-	Content     *string   `json:"content,omitempty"`
-	ImagePath   *string   `json:"image_path,omitempty"`
-	ImageName   *string   `json:"image_name,omitempty"`
+	Id          int         `json:"id"`
+	Title       string      `json:"title"`
+	Author      string      `json:"author"`
+	ContentType string      `json:"content_type"`
+	Category    string      `json:"category"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	IsPublished bool        `json:"is_published"`
+	PublishAt   *time.Time  `json:"publish_at,omitempty"`
+	PublishedAt *time.Time  `json:"published_at,omitempty"`
+	DeletedAt   *time.Time  `json:"deleted_at,omitempty"`
+	Content     *string     `json:"content,omitempty"`
+	ImagePath   *string     `json:"image_path,omitempty"`
+	ImageName   *string     `json:"image_name,omitempty"`
+	ImageURL    *string     `json:"image_url,omitempty"`
+	Images      []WorkImage `json:"images,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
 }
 
 func main() {
@@ -53,66 +54,89 @@ func main() {
 	}
 	defer db.Close()
 
-	// create table if not exists
-	query := `
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY, 
-			username VARCHAR(255) NOT NULL, 
-			email TEXT NOT NULL UNIQUE, 
-			password VARCHAR(255) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, 
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-		CREATE TABLE IF NOT EXISTS works (
-			id SERIAL PRIMARY KEY, 
-			title VARCHAR(255) NOT NULL, 
-			author VARCHAR(255) NOT NULL, 
-			content_type VARCHAR(50) NOT NULL,
-			category VARCHAR(50) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, 
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			is_published BOOLEAN DEFAULT FALSE
-		);
-		CREATE TABLE IF NOT EXISTS images (
-			id SERIAL PRIMARY KEY,
-			work_id INTEGER REFERENCES works(id) ON DELETE CASCADE,
-			image_path VARCHAR(255) NOT NULL,
-			image_name VARCHAR(255) NOT NULL 
-		);
-		CREATE TABLE IF NOT EXISTS texts (
-			id SERIAL PRIMARY KEY,
-			work_id INTEGER REFERENCES works(id) ON DELETE CASCADE,
-			content TEXT NOT NULL 
-		);`
-
-	_, err = db.Exec(query)
+	// subcommands such as "api migrate up" run against the db and exit
+	if len(os.Args) > 1 {
+		if err := runCommand(db, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// refuse to start on a schema newer than this binary, then apply pending migrations
+	if err := checkSchemaVersion(db); err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv("AUTO_MIGRATE") != "false" {
+		if err := migrateUp(db, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := bootstrapAdmin(db); err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := newStorage()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	go runPublisher(db)
+	go runTrashPurger(db, store)
+
 	// create router
 	router := mux.NewRouter()
-	router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("/app/uploads"))))
+	router.PathPrefix("/uploads/").Handler(serveUploads(store))
 
 	// user features
-	router.HandleFunc("/api/works", getWorks(db)).Methods("GET")
-	router.HandleFunc("/api/works/{category}", getCategoryWorks(db)).Methods("GET")
-	router.HandleFunc("/api/work/{id}", getWork(db)).Methods("GET")
+	router.Handle("/api/works", publicCache(getWorks(db, store, false))).Methods("GET")
+	router.Handle("/api/works/{category}", publicCache(getCategoryWorks(db, store, false))).Methods("GET")
+	router.Handle("/api/work/{id}", publicCache(getWork(db, store, false))).Methods("GET")
+	router.Handle("/api/search", publicCache(searchWorks(db))).Methods("GET")
+	router.Handle("/api/categories", publicCache(getCategories(db))).Methods("GET")
+	router.Handle("/api/tags", publicCache(getTags(db))).Methods("GET")
 
 	// admin features
 	router.HandleFunc("/api/admin/login", adminLogin(db)).Methods("POST") // No authentication needed for login
-
-	router.Handle("/api/admin", authenticate(http.HandlerFunc(authHandler))).Methods("GET")
-	router.Handle("/api/users/{id}", authenticate(http.HandlerFunc(getUser(db)))).Methods("GET")
-	router.Handle("/api/users/{id}", authenticate(http.HandlerFunc(updateUser(db)))).Methods("PUT")
-
-	router.Handle("/api/works", authenticate(http.HandlerFunc(createWork(db)))).Methods("POST")
-	router.Handle("/api/works/{id}", authenticate(http.HandlerFunc(updateWork(db)))).Methods("PUT")
-	router.Handle("/api/works/{id}", authenticate(http.HandlerFunc(deleteWork(db)))).Methods("DELETE")
-	router.Handle("/api/work/{id}", authenticate(http.HandlerFunc(publishWork(db)))).Methods("PUT")
-
-	// wrap the router with CORS and JSON content type middlewares
-	enhancedRouter := enableCORS(jsonContentTypeMiddleware(router))
+	router.HandleFunc("/api/admin/login/totp", loginTOTP(db)).Methods("POST")
+	router.HandleFunc("/api/admin/refresh", refreshTokens(db)).Methods("POST")
+	router.HandleFunc("/api/admin/logout", adminLogout(db)).Methods("POST")
+
+	router.Handle("/api/admin", authenticate(db, http.HandlerFunc(authHandler))).Methods("GET")
+	router.Handle("/api/admin/works", cacheControl(privateCacheControl, authenticate(db, http.HandlerFunc(getWorks(db, store, true))))).Methods("GET")
+	router.Handle("/api/admin/works/category/{category}", cacheControl(privateCacheControl, authenticate(db, http.HandlerFunc(getCategoryWorks(db, store, true))))).Methods("GET")
+	router.Handle("/api/admin/works/{id}", cacheControl(privateCacheControl, authenticate(db, http.HandlerFunc(getWork(db, store, true))))).Methods("GET")
+	router.Handle("/api/admin/trash", authenticate(db, requirePermission(permDeleteWorks, http.HandlerFunc(getTrash(db, store))))).Methods("GET")
+	router.Handle("/api/admin/works/{id}/revisions", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(getWorkRevisions(db))))).Methods("GET")
+	router.Handle("/api/admin/works/{id}/revisions/{rev:[0-9]+}", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(getWorkRevision(db, store))))).Methods("GET")
+	router.Handle("/api/admin/works/{id}/revisions/{rev:[0-9]+}/diff", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(diffWorkRevisions(db, store))))).Methods("GET")
+	router.Handle("/api/users/me", authenticate(db, http.HandlerFunc(getCurrentUser))).Methods("GET")
+	router.Handle("/api/users/me/totp", authenticate(db, http.HandlerFunc(enrollTOTP(db)))).Methods("POST")
+	router.Handle("/api/users/me/totp", authenticate(db, http.HandlerFunc(disableTOTP(db)))).Methods("DELETE")
+	router.Handle("/api/users/me/totp/verify", authenticate(db, http.HandlerFunc(confirmTOTP(db)))).Methods("POST")
+	router.Handle("/api/users/{id}", authenticate(db, http.HandlerFunc(getUser(db)))).Methods("GET")
+	router.Handle("/api/users/{id}", authenticate(db, http.HandlerFunc(updateUser(db)))).Methods("PUT")
+	router.Handle("/api/users/{id}/password", authenticate(db, http.HandlerFunc(changePassword(db)))).Methods("PUT")
+	router.Handle("/api/users/{id}/role", authenticate(db, requirePermission(permManageUsers, http.HandlerFunc(updateUserRole(db))))).Methods("PUT")
+
+	router.Handle("/api/categories", authenticate(db, requirePermission(permManageCategories, http.HandlerFunc(createCategory(db))))).Methods("POST")
+	router.Handle("/api/categories/{slug}", authenticate(db, requirePermission(permManageCategories, http.HandlerFunc(updateCategory(db))))).Methods("PUT")
+	router.Handle("/api/categories/{slug}", authenticate(db, requirePermission(permManageCategories, http.HandlerFunc(deleteCategory(db))))).Methods("DELETE")
+
+	router.Handle("/api/works", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(createWork(db, store))))).Methods("POST")
+	router.Handle("/api/works/{id}", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(updateWork(db, store))))).Methods("PUT")
+	router.Handle("/api/works/{id}", authenticate(db, requirePermission(permDeleteWorks, http.HandlerFunc(deleteWork(db))))).Methods("DELETE")
+	router.Handle("/api/works/{id}/images", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(addWorkImages(db, store))))).Methods("POST")
+	router.Handle("/api/works/{id}/images/order", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(reorderWorkImages(db, store))))).Methods("PUT")
+	router.Handle("/api/works/{id}/images/{imageId:[0-9]+}", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(updateWorkImage(db, store))))).Methods("PUT")
+	router.Handle("/api/works/{id}/images/{imageId:[0-9]+}", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(deleteWorkImage(db, store))))).Methods("DELETE")
+	router.Handle("/api/works/{id}/restore", authenticate(db, requirePermission(permDeleteWorks, http.HandlerFunc(restoreWork(db))))).Methods("POST")
+	router.Handle("/api/works/{id}/revisions/{rev:[0-9]+}/restore", authenticate(db, requirePermission(permWriteWorks, http.HandlerFunc(restoreWorkRevision(db, store))))).Methods("POST")
+	router.Handle("/api/works/{id}/schedule", authenticate(db, requirePermission(permPublishWorks, http.HandlerFunc(scheduleWork(db))))).Methods("PUT")
+	router.Handle("/api/works/{id}/publish", authenticate(db, requirePermission(permPublishWorks, http.HandlerFunc(publishWork(db))))).Methods("POST")
+	router.Handle("/api/works/{id}/unpublish", authenticate(db, requirePermission(permPublishWorks, http.HandlerFunc(unpublishWork(db))))).Methods("POST")
+
+	// wrap the router with CORS, JSON content type and caching middlewares
+	enhancedRouter := enableCORS(jsonContentTypeMiddleware(noStoreMiddleware(router)))
 
 	// start server
 	log.Fatal(http.ListenAndServe(":8000", enhancedRouter))
@@ -122,29 +146,43 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*") // allow any origin
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match, If-Modified-Since")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
 
 		// pass down the request to the next middleware (or final handler)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// api responses are json, stored files under /uploads/ set their own type
 func jsonContentTypeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Content-Type", "application/json")
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// get the logged in user
+func getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(currentUser(r))
+}
+
 // get single user
 func getUser(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
+		if !canManageUser(currentUser(r), id) {
+			http.Error(w, "You do not have access to this user", http.StatusForbidden)
+			return
+		}
+
 		var u User
-		err := db.QueryRow("SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1", id).Scan(
-			&u.Id, &u.Username, &u.Email, &u.CreatedAt, &u.UpdatedAt)
+		err := db.QueryRow("SELECT id, username, email, role, created_at, updated_at FROM users WHERE id = $1", id).Scan(
+			&u.Id, &u.Username, &u.Email, &u.Role, &u.CreatedAt, &u.UpdatedAt)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -153,112 +191,363 @@ func getUser(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// update user
+// update user, a new username ends the user's other sessions like a password change does
 func updateUser(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var u User
-		json.NewDecoder(r.Body).Decode(&u)
-
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		_, err := db.Exec("UPDATE users SET username = $1, email = $2, updated_at = NOW() WHERE id = $3", u.Username, u.Email, id)
+		if !canManageUser(currentUser(r), id) {
+			http.Error(w, "You do not have access to this user", http.StatusForbidden)
+			return
+		}
+
+		var u User
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		u.Username = strings.TrimSpace(u.Username)
+		u.Email = strings.TrimSpace(u.Email)
+		if u.Username == "" || u.Email == "" {
+			http.Error(w, "Username and email are required", http.StatusBadRequest)
+			return
+		}
+		if len(u.Username) > 255 {
+			http.Error(w, "Username must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
 		if err != nil {
-			log.Fatal(err)
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		var userID int
+		var currentUsername string
+		err = tx.QueryRow("SELECT id, username FROM users WHERE id = $1 FOR UPDATE", id).Scan(&userID, &currentUsername)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to fetch user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE (username = $1 OR email = $2) AND id <> $3)",
+			u.Username, u.Email, userID).Scan(&exists)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to check existing users: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			tx.Rollback()
+			http.Error(w, errUserExists.Error(), http.StatusConflict)
+			return
+		}
+
+		renamed := u.Username != currentUsername
 		var updatedUser User
-		err = db.QueryRow("SELECT id, username, email, created_at, updated_at FROM users WHERE id = $1", id).Scan(
-			&u.Id, &u.Username, &u.Email, &u.CreatedAt, &u.UpdatedAt)
+		var tokenVersion int
+		err = tx.QueryRow(`UPDATE users SET username = $1, email = $2, updated_at = NOW(),
+				token_version = token_version + CASE WHEN $4 THEN 1 ELSE 0 END
+			WHERE id = $3
+			RETURNING id, username, email, role, created_at, updated_at, token_version`, u.Username, u.Email, userID, renamed).Scan(
+			&updatedUser.Id, &updatedUser.Username, &updatedUser.Email, &updatedUser.Role, &updatedUser.CreatedAt, &updatedUser.UpdatedAt, &tokenVersion)
+		// a concurrent update can still take the name between the check and the update
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			tx.Rollback()
+			http.Error(w, errUserExists.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to update user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if renamed {
+			if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to revoke refresh tokens: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resp := struct {
+			User
+			Tokens *tokenPair `json:"tokens,omitempty"`
+		}{User: updatedUser}
+
+		// like a password change, renaming yourself hands back fresh tokens for this session
+		if renamed && currentUser(r).Id == userID {
+			tokens, err := issueTokens(tx, userID, updatedUser.Username, updatedUser.Role, tokenVersion, "")
+			if err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+				return
+			}
+			resp.Tokens = &tokens
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// change a user's role
+func updateUserRole(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var req struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !validRole(req.Role) {
+			http.Error(w, "Invalid role", http.StatusBadRequest)
+			return
+		}
+
+		var u User
+		err := db.QueryRow("SELECT id, username, email FROM users WHERE id = $1", id).Scan(&u.Id, &u.Username, &u.Email)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// keep at least one admin around to manage the others
+		if u.Id == currentUser(r).Id && req.Role != "admin" {
+			http.Error(w, "You cannot remove your own admin role", http.StatusConflict)
+			return
+		}
+
+		if err := setRole(db, u.Username, req.Role); err != nil {
+			http.Error(w, "Failed to update role: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		u.Role = req.Role
+		json.NewEncoder(w).Encode(u)
+	}
+}
+
+// change password after verifying the current one, previously issued tokens stop working
+func changePassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !canManageUser(currentUser(r), id) {
+			http.Error(w, "You do not have access to this user", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var userID int
+		var username, role, storedPassword string
+		err := db.QueryRow("SELECT id, username, role, password FROM users WHERE id = $1", id).Scan(&userID, &username, &role, &storedPassword)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to fetch user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(req.CurrentPassword)); err != nil {
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		if err := validatePassword(username, req.NewPassword); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tokenVersion, err := setPassword(db, username, req.NewPassword)
 		if err != nil {
-			log.Fatal(err)
+			http.Error(w, "Failed to update password: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-		json.NewEncoder(w).Encode(updatedUser)
+
+		// an admin changing someone else's password gets no session as that user
+		if currentUser(r).Id != userID {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// hand back fresh tokens so the caller stays logged in while every other session ends
+		tokens, err := issueTokens(db, userID, username, role, tokenVersion, "")
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tokens)
 	}
 }
 
-// get all works
-func getWorks(db *sql.DB) http.HandlerFunc {
+// get all works, drafts are only included for admin routes
+func getWorks(db *sql.DB, store Storage, includeDrafts bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query(`SELECT id, title, content_type, created_at, category, is_published FROM works`)
+		params, err := parseWorkListParams(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
 
-		var works []Work
-		for rows.Next() {
-			var work Work
+		var filter workFilter
+		filter.add("deleted_at IS NULL")
+		addDraftFilter(&filter, r, includeDrafts)
+		if err := addTagFilter(&filter, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-			if err := rows.Scan(&work.Id, &work.Title, &work.ContentType, &work.CreatedAt, &work.Category, &work.IsPublished); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			works = append(works, work)
+		etag, lastModified, err := listingValidators(db, r, filter)
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-		if err := rows.Err(); err != nil {
+		if notModified(w, r, etag, lastModified) {
+			return
+		}
+
+		page, err := queryWorkPage(db, filter, params)
+		if err == nil {
+			err = attachImages(db, store, page.Works)
+		}
+		if err == nil {
+			err = attachTags(db, page.Works)
+		}
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(works)
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
-// get category works
-func getCategoryWorks(db *sql.DB) http.HandlerFunc {
+// get category works, drafts are only included for admin routes
+func getCategoryWorks(db *sql.DB, store Storage, includeDrafts bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		category := vars["category"]
 
-		rows, err := db.Query(`SELECT id, title, content_type, author, created_at, category, is_published FROM works 
-		WHERE category = $1`, category)
+		params, err := parseWorkListParams(r)
 		if err != nil {
-			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
 
-		var works []Work
+		var filter workFilter
+		filter.add("category = ?", category)
+		filter.add("deleted_at IS NULL")
+		addDraftFilter(&filter, r, includeDrafts)
+		if err := addTagFilter(&filter, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		for rows.Next() {
-			var work Work
-			err := rows.Scan(&work.Id, &work.Title, &work.ContentType, &work.Author, &work.CreatedAt, &work.Category, &work.IsPublished)
+		etag, lastModified, err := listingValidators(db, r, filter)
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if notModified(w, r, etag, lastModified) {
+			return
+		}
 
-			if err != nil {
-				http.Error(w, "Error scanning row: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			works = append(works, work)
+		page, err := queryWorkPage(db, filter, params)
+		if err == nil {
+			err = attachImages(db, store, page.Works)
 		}
-		if err := rows.Err(); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err == nil {
+			err = attachTags(db, page.Works)
+		}
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(works)
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
-// get single work
-func getWork(db *sql.DB) http.HandlerFunc {
+// limit drafts to admin routes, where users without permViewDrafts only see their own
+func addDraftFilter(filter *workFilter, r *http.Request, includeDrafts bool) {
+	if user := currentUser(r); !includeDrafts || user == nil {
+		filter.add("is_published = TRUE")
+	} else if !hasPermission(user, permViewDrafts) {
+		filter.add("(is_published = TRUE OR user_id = ?)", user.Id)
+	}
+}
+
+// get single work, drafts are only served on admin routes
+func getWork(db *sql.DB, store Storage, includeDrafts bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
 		var work Work
 
-		err := db.QueryRow(`
+		where := ` WHERE work.id = $1 AND work.deleted_at IS NULL`
+		args := []interface{}{id}
+		if user := currentUser(r); !includeDrafts || user == nil {
+			where += ` AND work.is_published = TRUE`
+		} else if !hasPermission(user, permViewDrafts) {
+			where += ` AND (work.is_published = TRUE OR work.user_id = $2)`
+			args = append(args, user.Id)
+		}
+
+		// answer conditional requests from updated_at before loading the work
+		var workID int
+		var updatedAt time.Time
+		err := db.QueryRow(`SELECT work.id, work.updated_at FROM works work`+where, args...).Scan(&workID, &updatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Work not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error retrieving work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		etag, lastModified := workValidators(workID, updatedAt)
+		if notModified(w, r, etag, lastModified) {
+			return
+		}
+
+		query := `
             SELECT 
                 work.id, work.title, work.author, work.content_type, work.category, work.created_at, work.updated_at, work.is_published,
-                t.content, i.image_path, i.image_name
+                work.publish_at, work.published_at, t.content
             FROM works work 
-            LEFT JOIN texts t ON work.id = t.work_id 
-            LEFT JOIN images i ON work.id = i.work_id 
-            WHERE work.id = $1`, id).Scan(
+            LEFT JOIN texts t ON work.id = t.work_id` + where
+
+		err = db.QueryRow(query, args...).Scan(
 			&work.Id, &work.Title, &work.Author, &work.ContentType, &work.Category, &work.CreatedAt, &work.UpdatedAt, &work.IsPublished,
-			&work.Content, &work.ImagePath, &work.ImageName)
+			&work.PublishAt, &work.PublishedAt, &work.Content)
 		if err == sql.ErrNoRows {
 			http.Error(w, "Work not found", http.StatusNotFound)
 			return
@@ -267,16 +556,25 @@ func getWork(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		works := []Work{work}
+		err = attachImages(db, store, works)
+		if err == nil {
+			err = attachTags(db, works)
+		}
+		if err != nil {
+			http.Error(w, "Error retrieving work details: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(work)
+		json.NewEncoder(w).Encode(works[0])
 	}
 }
 
 // create work
-func createWork(db *sql.DB) http.HandlerFunc {
+func createWork(db *sql.DB, store Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		if !parseUploadForm(db, w, r) {
 			return
 		}
 
@@ -291,69 +589,62 @@ func createWork(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		if (contentType == "text" && (category != "poem" && category != "story")) ||
-			(contentType == "image" && (category != "pixel-art" && category != "glitch-art" && category != "digital-art" && category != "photography")) {
-			http.Error(w, "Category must be relevant to content type", http.StatusBadRequest)
+		if !validateCategory(db, w, category, contentType) {
 			return
 		}
-
-		tx, err := db.Begin()
+		rules, err := categoryUploadRules(db, category)
 		if err != nil {
-			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Failed to fetch category: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		var workID int
-		err = tx.QueryRow(`
-            INSERT INTO works (title, author, content_type, category, created_at, updated_at, is_published)
-            VALUES ($1, $2, $3, $4, NOW(), NOW(), $5) RETURNING id`,
-			title, author, contentType, category, true).Scan(&workID)
+		tags, err := parseTags(r.MultipartForm.Value["tags"])
 		if err != nil {
-			tx.Rollback()
-			http.Error(w, "Failed to insert work: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if contentType == "image" {
-			file, handler, err := r.FormFile("file")
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, "Failed to read uploaded file: "+err.Error(), http.StatusBadRequest)
+		// works are published right away by users allowed to publish, unless sent as a draft.
+		// a publish_at schedules the draft for the background publisher
+		canPublish := hasPermission(currentUser(r), permPublishWorks)
+		isPublished := canPublish && r.FormValue("draft") != "true"
+		var publishAt *time.Time
+		if v := r.FormValue("publish_at"); v != "" {
+			if !canPublish {
+				http.Error(w, "You do not have permission to schedule works", http.StatusForbidden)
 				return
 			}
-			defer file.Close()
-
-			uploadDir := "/frontend/public/works"
-			if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-				tx.Rollback()
-				http.Error(w, "Failed to create upload directory: "+err.Error(), http.StatusInternalServerError)
+			if publishAt, err = parsePublishAt(v); err != nil {
+				http.Error(w, "publish_at must be an RFC 3339 timestamp", http.StatusBadRequest)
 				return
 			}
+			isPublished = false
+		}
 
-			ext := filepath.Ext(handler.Filename)
-			uniqueFilename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			filePath := filepath.Join(uploadDir, uniqueFilename)
-			out, err := os.Create(filePath)
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer out.Close()
-			if _, err := io.Copy(out, file); err != nil {
-				tx.Rollback()
-				http.Error(w, "Failed to write file: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+		var workID int
+		err = tx.QueryRow(`
+            INSERT INTO works (title, author, content_type, category, created_at, updated_at, is_published, published_at, publish_at, user_id)
+            VALUES ($1, $2, $3, $4, NOW(), NOW(), $5, CASE WHEN $5 THEN NOW() END, $6, $7) RETURNING id`,
+			title, author, contentType, category, isPublished, publishAt, currentUser(r).Id).Scan(&workID)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to insert work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			_, err = tx.Exec(`INSERT INTO images (work_id, image_path, image_name) VALUES ($1, $2, $3)`,
-				workID, filePath, uniqueFilename)
-			if err != nil {
-				tx.Rollback()
-				http.Error(w, "Failed to save image metadata: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+		// every file becomes one of the work's images, in upload order. the files only move
+		// into place once the rows pointing at them are committed
+		staged := stageWrites(store)
+		defer staged.rollback(r.Context())
+		if contentType == "image" && !saveUploadedImages(w, r, tx, staged, workID, rules) {
+			tx.Rollback()
+			return
 		}
 
 		if contentType == "text" {
@@ -365,10 +656,23 @@ func createWork(db *sql.DB) http.HandlerFunc {
 			}
 		}
 
+		if err := setWorkTags(tx, workID, tags); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to save tags: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := recordRevision(tx, store, workID, currentUser(r), nil); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		if err := tx.Commit(); err != nil {
 			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		staged.commit(r.Context())
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -378,17 +682,23 @@ func createWork(db *sql.DB) http.HandlerFunc {
 			"author":       author,
 			"category":     category,
 			"content_type": contentType,
+			"tags":         tags,
+			"is_published": isPublished,
+			"publish_at":   publishAt,
 		})
 	}
 }
 
 // update work
-func updateWork(db *sql.DB) http.HandlerFunc {
+func updateWork(db *sql.DB, store Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
 
-		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+
+		if !parseUploadForm(db, w, r) {
 			return
 		}
 
@@ -403,16 +713,44 @@ func updateWork(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if !validateCategory(db, w, category, contentType) {
+			return
+		}
+		rules, err := categoryUploadRules(db, category)
+		if err != nil {
+			http.Error(w, "Failed to fetch category: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// tags are only replaced when the form sends them
+		tagValues, updateTags := r.MultipartForm.Value["tags"]
+		tags, err := parseTags(tagValues)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		tx, err := db.Begin()
 		if err != nil {
 			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Fetch current image path if the work is of type "image"
-		var oldImagePath string
+		if err := beginRevision(tx, store, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Fetch the cover image and its files if the work is of type "image", an uploaded file replaces it.
+		// the other images of the work are managed through /api/works/{id}/images
+		var imageID int
+		var oldFiles []string
 		if contentType == "image" {
-			err = tx.QueryRow(`SELECT image_path FROM images WHERE work_id = $1`, id).Scan(&oldImagePath)
+			err = tx.QueryRow(`SELECT id FROM images WHERE work_id = $1 ORDER BY position, id LIMIT 1`, id).Scan(&imageID)
+			if err == nil {
+				oldFiles, err = imageFiles(tx, "i.id = $1", imageID)
+			}
 			if err != nil && err != sql.ErrNoRows {
 				tx.Rollback()
 				http.Error(w, "Failed to retrieve old image: "+err.Error(), http.StatusInternalServerError)
@@ -429,48 +767,44 @@ func updateWork(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Handle image file upload
+		// Handle image file upload, staged until the transaction commits
+		staged := stageWrites(store)
+		defer staged.rollback(r.Context())
 		file, handler, err := r.FormFile("file")
+		if err == nil && contentType != "image" {
+			file.Close()
+			tx.Rollback()
+			http.Error(w, "Only image works have images", http.StatusBadRequest)
+			return
+		}
 		if err == nil { // A new file was uploaded
 			defer file.Close()
 
-			uploadDir := "/frontend/public/works"
-			if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+			fileType, uploadErr := validateUpload(file, handler, rules)
+			if uploadErr != nil {
 				tx.Rollback()
-				http.Error(w, "Failed to create upload directory: "+err.Error(), http.StatusInternalServerError)
+				writeUploadError(w, uploadErr)
 				return
 			}
 
-			ext := filepath.Ext(handler.Filename)
-			uniqueFilename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
-			filePath := filepath.Join(uploadDir, uniqueFilename)
-
-			out, err := os.Create(filePath)
+			img, err := storeImage(r.Context(), tx, staged, file, fileType, rules.pixelated)
 			if err != nil {
 				tx.Rollback()
-				http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer out.Close()
-			if _, err := io.Copy(out, file); err != nil {
-				tx.Rollback()
-				http.Error(w, "Failed to write file: "+err.Error(), http.StatusInternalServerError)
+				http.Error(w, "Failed to save file: "+err.Error(), imageErrorStatus(err))
 				return
 			}
 
-			// Update the image metadata
-			_, err = tx.Exec(`UPDATE images SET image_path = $1, image_name = $2 WHERE work_id = $3`,
-				filePath, uniqueFilename, id)
+			// Update the image metadata, EXIF and variants
+			if imageID == 0 {
+				_, err = insertImage(tx, id, img)
+			} else {
+				err = replaceImage(tx, imageID, img)
+			}
 			if err != nil {
 				tx.Rollback()
 				http.Error(w, "Failed to update image metadata: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
-
-			// Remove the old image file
-			if oldImagePath != "" {
-				os.Remove(oldImagePath)
-			}
 		} else if err != http.ErrMissingFile && contentType == "image" {
 			tx.Rollback()
 			http.Error(w, "Failed to read uploaded file: "+err.Error(), http.StatusBadRequest)
@@ -487,10 +821,28 @@ func updateWork(db *sql.DB) http.HandlerFunc {
 			}
 		}
 
+		if updateTags {
+			if err := setWorkTags(tx, id, tags); err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to update tags: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if _, err := recordRevision(tx, store, id, currentUser(r), nil); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		if err := tx.Commit(); err != nil {
 			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		staged.commit(r.Context())
+
+		// the replaced image stays in storage while earlier revisions refer to it
+		deleteUnreferencedFiles(r.Context(), db, store, oldFiles)
 
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -499,51 +851,21 @@ func updateWork(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// delete work
+// move a work to the trash, it is removed for good by the purge once the retention has passed
 func deleteWork(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
 
-		var work Work
-		var imagePath sql.NullString
-
-		err := db.QueryRow(`SELECT w.id, w.content_type, i.image_path 
-                            FROM works w 
-                            LEFT JOIN images i ON w.id = i.work_id 
-                            WHERE w.id = $1`, id).Scan(&work.Id, &work.ContentType, &imagePath)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Work not found", http.StatusNotFound)
-			} else {
-				http.Error(w, "Failed to fetch work details: "+err.Error(), http.StatusInternalServerError)
-			}
-			return
-		}
-
-		tx, err := db.Begin()
-		if err != nil {
-			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+		if !authorizeWork(db, w, r, id) {
 			return
 		}
 
-		_, err = tx.Exec(`DELETE FROM works WHERE id = $1`, id)
+		_, err := db.Exec(`UPDATE works SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`, id)
 		if err != nil {
-			tx.Rollback()
 			http.Error(w, "Failed to delete work: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if work.ContentType == "image" && imagePath.Valid {
-			if err := os.Remove(imagePath.String); err != nil {
-				log.Printf("Failed to delete image file: %s", err.Error())
-			}
-		}
-
-		if err := tx.Commit(); err != nil {
-			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status": "success",
@@ -551,103 +873,48 @@ func deleteWork(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// publish the work
+// publish a draft, 409 when it is already published
 func publishWork(db *sql.DB) http.HandlerFunc {
+	return setPublished(db, true)
+}
+
+// turn a published work back into a draft, 409 when it is already a draft
+func unpublishWork(db *sql.DB) http.HandlerFunc {
+	return setPublished(db, false)
+}
+
+// move a work to the published state or out of it. the transition only applies from the other
+// state, so a retried request can't flip the work back. either way a pending schedule is dropped
+func setPublished(db *sql.DB, publish bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		id := vars["id"]
 
-		_, err := db.Exec("UPDATE works SET updated_at = NOW(), is_published = NOT is_published WHERE id = $1", id)
-		if err != nil {
-			http.Error(w, "failed to change visibility of the work: "+err.Error(), http.StatusInternalServerError)
+		if !authorizeWork(db, w, r, id) {
 			return
 		}
 
 		var updatedWork Work
-		err = db.QueryRow(`
-			SELECT id, title, author, content_type, category, created_at, updated_at, is_published FROM works WHERE id = $1`, id).Scan(
+		err := db.QueryRow(`
+			UPDATE works SET is_published = $2, published_at = CASE WHEN $2 THEN NOW() END, publish_at = NULL, updated_at = NOW()
+			WHERE id = $1 AND is_published <> $2
+			RETURNING id, title, author, content_type, category, created_at, updated_at, is_published, published_at`, id, publish).Scan(
 			&updatedWork.Id, &updatedWork.Title, &updatedWork.Author, &updatedWork.ContentType, &updatedWork.Category,
-			&updatedWork.CreatedAt, &updatedWork.UpdatedAt, &updatedWork.IsPublished)
-
-		if err != nil {
-			http.Error(w, "failed to fetch updated work: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(updatedWork)
-
-	}
-}
-
-func authenticate(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Authorization token required", http.StatusUnauthorized)
-			return
-		}
-
-		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, errors.New("unexpected signing method")
+			&updatedWork.CreatedAt, &updatedWork.UpdatedAt, &updatedWork.IsPublished, &updatedWork.PublishedAt)
+		if err == sql.ErrNoRows {
+			if publish {
+				http.Error(w, "Work is already published", http.StatusConflict)
+			} else {
+				http.Error(w, "Work is not published", http.StatusConflict)
 			}
-			return secretKey, nil
-		})
-
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-func adminLogin(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var admin User
-
-		if err := json.NewDecoder(r.Body).Decode(&admin); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		var storedPassword string
-
-		err := db.QueryRow("SELECT password FROM users WHERE username = $1", admin.Username).Scan(&storedPassword)
-		if err != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
-		}
-
-		if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(admin.Password)); err != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		}
-
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"username": admin.Username,
-			"exp":      time.Now().Add(time.Hour * 24).Unix(),
-		})
-
-		tokenString, err := token.SignedString(secretKey)
-		if err != nil {
-			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		} else if err != nil {
+			http.Error(w, "failed to change visibility of the work: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"token": tokenString,
-		})
+		json.NewEncoder(w).Encode(updatedWork)
 	}
 }
-
-func authHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{}`))
-}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// arbitrary key for pg_advisory_lock so replicas starting together don't migrate twice
+const migrationLockKey = 7245901
+
+// migration files are named <version>_<name>.up.sql and <version>_<name>.down.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// load the embedded migrations ordered by version
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		body, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	return err
+}
+
+// applied migration versions mapped to when they were applied
+func appliedMigrations(db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// fail if the database was migrated by a newer binary than this one
+func checkSchemaVersion(db *sql.DB) error {
+	current, latest, err := schemaVersions(db)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than the latest known migration %d, refusing to run", current, latest)
+	}
+	return nil
+}
+
+// fail unless the database is at exactly the schema of this binary, for commands that don't
+// migrate on their own
+func checkSchemaCurrent(db *sql.DB) error {
+	if err := checkSchemaVersion(db); err != nil {
+		return err
+	}
+	current, latest, err := schemaVersions(db)
+	if err != nil {
+		return err
+	}
+	if current < latest {
+		return fmt.Errorf("database schema version %d is behind the latest migration %d, run `api migrate up` first", current, latest)
+	}
+	return nil
+}
+
+// the version the database was migrated to and the latest embedded migration
+func schemaVersions(db *sql.DB) (int, int, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return 0, 0, err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return 0, 0, err
+	}
+	return current, latest, nil
+}
+
+// run fn while holding the migration lock on a dedicated connection
+func withMigrationLock(db *sql.DB, fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	return fn(conn)
+}
+
+// apply every pending migration in order, each in its own transaction
+func migrateUp(db *sql.DB, out io.Writer) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if err := applyMigration(conn, m.up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name); err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", m.version, m.name, err)
+			}
+			fmt.Fprintf(out, "applied migration %d_%s\n", m.version, m.name)
+		}
+		return nil
+	})
+}
+
+// roll back the given number of most recently applied migrations
+func migrateDown(db *sql.DB, steps int, out io.Writer) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if err := applyMigration(conn, m.down, `DELETE FROM schema_migrations WHERE version = $1`, m.version); err != nil {
+				return fmt.Errorf("rollback of %d_%s failed: %w", m.version, m.name, err)
+			}
+			fmt.Fprintf(out, "rolled back migration %d_%s\n", m.version, m.name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// run a migration script and record it in schema_migrations within one transaction
+func applyMigration(conn *sql.Conn, script string, record string, args ...interface{}) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// print every known migration with its applied state
+func migrationStatus(db *sql.DB, out io.Writer) error {
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		state := "pending"
+		if appliedAt, ok := applied[m.version]; ok {
+			state = "applied " + appliedAt.Format(time.RFC3339)
+			delete(applied, m.version)
+		}
+		fmt.Fprintf(out, "%04d_%-30s %s\n", m.version, m.name, state)
+	}
+	// versions recorded in the database that this binary doesn't know about
+	for version := range applied {
+		fmt.Fprintf(out, "%04d_%-30s unknown to this binary\n", version, "?")
+	}
+	return nil
+}
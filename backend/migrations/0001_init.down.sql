@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS texts;
+DROP TABLE IF EXISTS images;
+DROP TABLE IF EXISTS works;
+DROP TABLE IF EXISTS users;
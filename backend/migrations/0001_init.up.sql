@@ -0,0 +1,33 @@
+-- IF NOT EXISTS keeps this a no-op on databases created before migrations existed
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	email TEXT NOT NULL UNIQUE,
+	password VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS works (
+	id SERIAL PRIMARY KEY,
+	title VARCHAR(255) NOT NULL,
+	author VARCHAR(255) NOT NULL,
+	content_type VARCHAR(50) NOT NULL,
+	category VARCHAR(50) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	is_published BOOLEAN DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS images (
+	id SERIAL PRIMARY KEY,
+	work_id INTEGER REFERENCES works(id) ON DELETE CASCADE,
+	image_path VARCHAR(255) NOT NULL,
+	image_name VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS texts (
+	id SERIAL PRIMARY KEY,
+	work_id INTEGER REFERENCES works(id) ON DELETE CASCADE,
+	content TEXT NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS texts_search_idx;
+DROP INDEX IF EXISTS works_search_idx;
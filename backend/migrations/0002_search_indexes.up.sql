@@ -0,0 +1,8 @@
+-- expressions must match worksSearchVector and textsSearchVector in search.go
+CREATE INDEX IF NOT EXISTS works_search_idx ON works USING GIN ((
+	setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', author), 'B')
+));
+
+CREATE INDEX IF NOT EXISTS texts_search_idx ON texts USING GIN ((
+	setweight(to_tsvector('simple', content), 'C')
+));
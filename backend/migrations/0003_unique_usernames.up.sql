@@ -0,0 +1,2 @@
+-- logins look users up by username, so it has to identify a single account
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (username);
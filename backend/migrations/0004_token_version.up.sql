@@ -0,0 +1,2 @@
+-- bumped whenever a user's password changes, tokens carrying an older version are rejected
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
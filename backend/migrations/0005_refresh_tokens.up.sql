@@ -0,0 +1,19 @@
+-- only sha-256 hashes of refresh tokens are stored. tokens rotated from the same
+-- login share a family so a reused, already rotated token can revoke the whole chain
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	token_hash CHAR(64) NOT NULL UNIQUE,
+	family_id CHAR(32) NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	revoked_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_idx ON refresh_tokens (user_id);
+
+-- access tokens revoked before they expire, keyed by their jti claim
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti CHAR(32) PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS works_user_idx;
+ALTER TABLE works DROP COLUMN IF EXISTS user_id;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,6 @@
+-- every account created before roles existed was an admin
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'admin';
+
+-- works created before ownership was tracked have no owner and can only be managed by admins
+ALTER TABLE works ADD COLUMN IF NOT EXISTS user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS works_user_idx ON works (user_id);
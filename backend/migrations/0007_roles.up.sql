@@ -0,0 +1,5 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('admin', 'editor', 'viewer'));
+
+-- new accounts get the least privileged role unless one is given
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'viewer';
@@ -0,0 +1,11 @@
+-- every login attempt, doubling as the audit trail of failed logins
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	ip VARCHAR(64) NOT NULL,
+	success BOOLEAN NOT NULL,
+	reason VARCHAR(50),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON login_attempts (username, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
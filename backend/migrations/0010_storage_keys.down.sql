@@ -0,0 +1 @@
+UPDATE images SET image_path = '/frontend/public/works/' || image_path WHERE image_path NOT LIKE '/%';
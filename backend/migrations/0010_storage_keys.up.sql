@@ -0,0 +1,3 @@
+-- image_path held absolute paths on the api container's disk, it now holds storage keys.
+-- uploads were always stored flat under their unique image_name
+UPDATE images SET image_path = image_name WHERE image_path LIKE '/%';
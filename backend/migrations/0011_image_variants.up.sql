@@ -0,0 +1,11 @@
+-- resized copies of an uploaded image, one row per size and format
+CREATE TABLE IF NOT EXISTS image_variants (
+	id SERIAL PRIMARY KEY,
+	image_id INTEGER NOT NULL REFERENCES images(id) ON DELETE CASCADE,
+	size VARCHAR(20) NOT NULL,
+	content_type VARCHAR(50) NOT NULL,
+	path VARCHAR(255) NOT NULL,
+	width INTEGER NOT NULL,
+	height INTEGER NOT NULL,
+	UNIQUE (image_id, size, content_type)
+);
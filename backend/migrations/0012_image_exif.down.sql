@@ -0,0 +1,7 @@
+ALTER TABLE images DROP COLUMN IF EXISTS taken_at;
+ALTER TABLE images DROP COLUMN IF EXISTS focal_length;
+ALTER TABLE images DROP COLUMN IF EXISTS iso;
+ALTER TABLE images DROP COLUMN IF EXISTS f_number;
+ALTER TABLE images DROP COLUMN IF EXISTS exposure_time;
+ALTER TABLE images DROP COLUMN IF EXISTS lens;
+ALTER TABLE images DROP COLUMN IF EXISTS camera;
@@ -0,0 +1,8 @@
+-- fields read from a photo's EXIF before it is stripped from the stored file
+ALTER TABLE images ADD COLUMN IF NOT EXISTS camera TEXT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS lens TEXT;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS exposure_time VARCHAR(20);
+ALTER TABLE images ADD COLUMN IF NOT EXISTS f_number REAL;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS iso INTEGER;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS focal_length REAL;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS taken_at TIMESTAMP;
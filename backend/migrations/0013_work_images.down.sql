@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS images_work_position_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS alt_text;
+ALTER TABLE images DROP COLUMN IF EXISTS caption;
+ALTER TABLE images DROP COLUMN IF EXISTS position;
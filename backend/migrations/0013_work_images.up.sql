@@ -0,0 +1,5 @@
+-- works hold an ordered list of images, each with its own caption and alt text
+ALTER TABLE images ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS caption TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN IF NOT EXISTS alt_text TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS images_work_position_idx ON images (work_id, position);
@@ -0,0 +1,2 @@
+ALTER TABLE works DROP CONSTRAINT IF EXISTS works_category_fkey;
+DROP TABLE IF EXISTS categories;
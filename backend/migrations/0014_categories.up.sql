@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS categories (
+	slug VARCHAR(50) PRIMARY KEY,
+	name VARCHAR(100) NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	content_type VARCHAR(50) NOT NULL CHECK (content_type IN ('text', 'image')),
+	sort_order INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO categories (slug, name, content_type, sort_order) VALUES
+	('poem', 'Poems', 'text', 10),
+	('story', 'Stories', 'text', 20),
+	('pixel-art', 'Pixel Art', 'image', 30),
+	('glitch-art', 'Glitch Art', 'image', 40),
+	('digital-art', 'Digital Art', 'image', 50),
+	('photography', 'Photography', 'image', 60)
+ON CONFLICT (slug) DO NOTHING;
+
+-- keep works whose category predates the table valid, their content type decides the category's
+INSERT INTO categories (slug, name, content_type, sort_order)
+SELECT DISTINCT ON (category) category, category, content_type, 100
+FROM works
+WHERE content_type IN ('text', 'image')
+ON CONFLICT (slug) DO NOTHING;
+
+ALTER TABLE works DROP CONSTRAINT IF EXISTS works_category_fkey;
+ALTER TABLE works ADD CONSTRAINT works_category_fkey
+	FOREIGN KEY (category) REFERENCES categories (slug) ON UPDATE CASCADE;
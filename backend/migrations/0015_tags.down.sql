@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS work_tags;
+DROP TABLE IF EXISTS tags;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS tags (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(50) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS work_tags (
+	work_id INTEGER NOT NULL REFERENCES works(id) ON DELETE CASCADE,
+	tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+	PRIMARY KEY (work_id, tag_id)
+);
+CREATE INDEX IF NOT EXISTS work_tags_tag_idx ON work_tags (tag_id);
@@ -0,0 +1,3 @@
+-- drafts with a publish_at are published by the background publisher once it has passed (UTC)
+ALTER TABLE works ADD COLUMN IF NOT EXISTS publish_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS works_publish_at_idx ON works (publish_at) WHERE is_published = FALSE AND publish_at IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE works DROP COLUMN IF EXISTS published_at;
@@ -0,0 +1,4 @@
+-- when a work was last published, NULL for drafts. works published before this was
+-- recorded get their creation time, most were published when they were created
+ALTER TABLE works ADD COLUMN IF NOT EXISTS published_at TIMESTAMP;
+UPDATE works SET published_at = created_at WHERE is_published = TRUE AND published_at IS NULL;
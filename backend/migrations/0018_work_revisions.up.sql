@@ -0,0 +1,19 @@
+-- immutable snapshots of a work after each change. files lists every storage key the
+-- snapshot refers to, images and variants stay on disk while any revision needs them
+CREATE TABLE IF NOT EXISTS work_revisions (
+	id SERIAL PRIMARY KEY,
+	work_id INTEGER NOT NULL REFERENCES works(id) ON DELETE CASCADE,
+	revision INTEGER NOT NULL,
+	title VARCHAR(255) NOT NULL,
+	author VARCHAR(255) NOT NULL,
+	category VARCHAR(50) NOT NULL,
+	content_type VARCHAR(50) NOT NULL,
+	content TEXT,
+	images JSONB NOT NULL DEFAULT '[]',
+	files TEXT[] NOT NULL DEFAULT '{}',
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	restored_from INTEGER,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (work_id, revision)
+);
+CREATE INDEX IF NOT EXISTS work_revisions_files_idx ON work_revisions USING GIN (files);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS works_deleted_at_idx;
+ALTER TABLE works DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,3 @@
+-- deleted works stay in the trash until the background purge removes them for good
+ALTER TABLE works ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS works_deleted_at_idx ON works (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS work_revisions_file_refs ON work_revisions;
+DROP TRIGGER IF EXISTS image_variants_file_refs ON image_variants;
+DROP TRIGGER IF EXISTS images_file_refs ON images;
+DROP FUNCTION IF EXISTS work_revisions_file_refs();
+DROP FUNCTION IF EXISTS image_variants_file_refs();
+DROP FUNCTION IF EXISTS images_file_refs();
+DROP FUNCTION IF EXISTS adjust_file_refs(TEXT[], INTEGER);
+DROP TABLE IF EXISTS stored_files;
@@ -0,0 +1,71 @@
+-- one row per stored file with how many images, variants and revision entries refer to it.
+-- new files are named by the sha-256 of their content, so identical uploads share a row.
+-- the counts are kept by the triggers below, files reaching zero are deleted by the api
+CREATE TABLE IF NOT EXISTS stored_files (
+	key VARCHAR(255) PRIMARY KEY,
+	content_type VARCHAR(100),
+	size BIGINT,
+	ref_count INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO stored_files (key, ref_count)
+SELECT key, COUNT(*) FROM (
+	SELECT image_path AS key FROM images
+	UNION ALL SELECT path FROM image_variants
+	UNION ALL SELECT unnest(files) FROM work_revisions
+) refs
+GROUP BY key
+ON CONFLICT (key) DO NOTHING;
+
+CREATE OR REPLACE FUNCTION adjust_file_refs(keys TEXT[], delta INTEGER) RETURNS VOID AS $$
+BEGIN
+	-- keys are sorted so concurrent transactions lock the rows in the same order
+	INSERT INTO stored_files (key, ref_count)
+	SELECT k, COUNT(*) * delta FROM unnest(keys) k GROUP BY k ORDER BY k
+	ON CONFLICT (key) DO UPDATE SET ref_count = stored_files.ref_count + EXCLUDED.ref_count;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION images_file_refs() RETURNS TRIGGER AS $$
+BEGIN
+	IF TG_OP <> 'INSERT' THEN
+		PERFORM adjust_file_refs(ARRAY[OLD.image_path::TEXT], -1);
+	END IF;
+	IF TG_OP <> 'DELETE' THEN
+		PERFORM adjust_file_refs(ARRAY[NEW.image_path::TEXT], 1);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION image_variants_file_refs() RETURNS TRIGGER AS $$
+BEGIN
+	IF TG_OP <> 'INSERT' THEN
+		PERFORM adjust_file_refs(ARRAY[OLD.path::TEXT], -1);
+	END IF;
+	IF TG_OP <> 'DELETE' THEN
+		PERFORM adjust_file_refs(ARRAY[NEW.path::TEXT], 1);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION work_revisions_file_refs() RETURNS TRIGGER AS $$
+BEGIN
+	IF TG_OP <> 'INSERT' THEN
+		PERFORM adjust_file_refs(OLD.files, -1);
+	END IF;
+	IF TG_OP <> 'DELETE' THEN
+		PERFORM adjust_file_refs(NEW.files, 1);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER images_file_refs AFTER INSERT OR UPDATE OF image_path OR DELETE ON images
+	FOR EACH ROW EXECUTE FUNCTION images_file_refs();
+CREATE TRIGGER image_variants_file_refs AFTER INSERT OR UPDATE OF path OR DELETE ON image_variants
+	FOR EACH ROW EXECUTE FUNCTION image_variants_file_refs();
+CREATE TRIGGER work_revisions_file_refs AFTER INSERT OR UPDATE OF files OR DELETE ON work_revisions
+	FOR EACH ROW EXECUTE FUNCTION work_revisions_file_refs();
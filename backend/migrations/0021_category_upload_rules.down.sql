@@ -0,0 +1,4 @@
+ALTER TABLE categories
+	DROP COLUMN IF EXISTS pixelated,
+	DROP COLUMN IF EXISTS max_upload_mb,
+	DROP COLUMN IF EXISTS image_types;
@@ -0,0 +1,12 @@
+-- upload rules per category, kept with the category so renaming it keeps them.
+-- NULL image_types accepts every format, NULL max_upload_mb falls back to UPLOAD_MAX_MB,
+-- pixelated categories are scaled nearest-neighbour and rendered without smoothing
+ALTER TABLE categories
+	ADD COLUMN IF NOT EXISTS image_types TEXT[],
+	ADD COLUMN IF NOT EXISTS max_upload_mb INTEGER CHECK (max_upload_mb > 0),
+	ADD COLUMN IF NOT EXISTS pixelated BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE categories SET image_types = '{image/png,image/gif}', pixelated = TRUE WHERE slug = 'pixel-art';
+UPDATE categories SET image_types = '{image/png,image/gif,image/jpeg,image/webp}' WHERE slug = 'glitch-art';
+UPDATE categories SET image_types = '{image/png,image/jpeg,image/webp,image/gif}' WHERE slug = 'digital-art';
+UPDATE categories SET image_types = '{image/jpeg,image/webp}', max_upload_mb = 25 WHERE slug = 'photography';
@@ -0,0 +1,3 @@
+ALTER TABLE works
+	ALTER COLUMN publish_at TYPE TIMESTAMP USING publish_at AT TIME ZONE 'UTC',
+	ALTER COLUMN published_at TYPE TIMESTAMP USING published_at AT TIME ZONE 'UTC';
@@ -0,0 +1,6 @@
+-- publish times become absolute so the publisher doesn't depend on the session time zone.
+-- publish_at was always written in UTC, published_at came from NOW() under the server's
+-- default UTC time zone
+ALTER TABLE works
+	ALTER COLUMN publish_at TYPE TIMESTAMPTZ USING publish_at AT TIME ZONE 'UTC',
+	ALTER COLUMN published_at TYPE TIMESTAMPTZ USING published_at AT TIME ZONE 'UTC';
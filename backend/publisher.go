@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var publishInterval = envDuration("PUBLISH_INTERVAL", time.Minute)
+
+// publish due scheduled works every publishInterval until the process exits
+func runPublisher(db *sql.DB) {
+	ticker := time.NewTicker(publishInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := publishDueWorks(db); err != nil {
+			log.Printf("Failed to publish scheduled works: %s", err.Error())
+		}
+	}
+}
+
+// flip drafts whose publish_at has passed to published. every replica runs this, SKIP LOCKED
+// lets each one claim different rows instead of waiting on the rows another replica is publishing
+func publishDueWorks(db *sql.DB) error {
+	rows, err := db.Query(`
+		UPDATE works SET is_published = TRUE, published_at = NOW(), publish_at = NULL, updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM works
+			WHERE is_published = FALSE AND publish_at <= NOW() AND deleted_at IS NULL
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		log.Printf("published scheduled work %d", id)
+	}
+	return rows.Err()
+}
+
+// parse an RFC 3339 publish_at. the column is a timestamptz, UTC keeps the responses uniform
+func parsePublishAt(v string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, err
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// schedule a draft for publishing, a null publish_at cancels the schedule
+func scheduleWork(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+
+		var req struct {
+			PublishAt *string `json:"publish_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		var publishAt *time.Time
+		if req.PublishAt != nil {
+			var err error
+			if publishAt, err = parsePublishAt(*req.PublishAt); err != nil {
+				http.Error(w, "publish_at must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+
+		res, err := db.Exec(`UPDATE works SET publish_at = $1, updated_at = NOW() WHERE id = $2 AND is_published = FALSE`, publishAt, id)
+		if err != nil {
+			http.Error(w, "Failed to schedule work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Only drafts can be scheduled", http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":         id,
+			"publish_at": publishAt,
+		})
+	}
+}
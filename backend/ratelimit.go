@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	loginMaxFailures   = envInt("LOGIN_MAX_FAILURES", 5)
+	loginIPMaxFailures = envInt("LOGIN_IP_MAX_FAILURES", 20)
+	loginWindow        = envDuration("LOGIN_WINDOW", 15*time.Minute)
+	loginLockout       = envDuration("LOGIN_LOCKOUT", 15*time.Minute)
+	loginBackoffBase   = envDuration("LOGIN_BACKOFF_BASE", time.Second)
+	trustProxyHeaders  = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+)
+
+// attempts rejected by the throttle are audited but don't count as failures,
+// otherwise hammering a locked account would keep it locked forever
+const reasonThrottled = "throttled"
+
+// client address of the request, proxy headers are only honoured when TRUST_PROXY_HEADERS is set
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// how long a login for the username from the ip has to wait, zero when it may proceed.
+// each failure doubles the wait, reaching maxFailures locks out for the lockout period.
+// a successful login clears the account's failures but not the ip's, otherwise one valid
+// account would let an attacker reset the throttle while guessing others
+func loginRetryAfter(db *sql.DB, username, ip string) (time.Duration, error) {
+	userWait, err := failureBackoff(db, "username", username, loginMaxFailures, true)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := failureBackoff(db, "ip", ip, loginIPMaxFailures, false)
+	if err != nil {
+		return 0, err
+	}
+	return max(userWait, ipWait), nil
+}
+
+// the remaining wait after the failures of one username or ip within the window,
+// counted since the last success when resetOnSuccess is set
+func failureBackoff(db *sql.DB, column, value string, maxFailures int, resetOnSuccess bool) (time.Duration, error) {
+	since := ""
+	if resetOnSuccess {
+		since = fmt.Sprintf(`
+			AND created_at > COALESCE((SELECT MAX(created_at) FROM login_attempts WHERE %[1]s = $1 AND success), '-infinity')`, column)
+	}
+
+	var failures int
+	var sinceLast sql.NullFloat64
+	err := db.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*), EXTRACT(EPOCH FROM NOW() - MAX(created_at))
+		FROM login_attempts
+		WHERE %[1]s = $1 AND success = FALSE AND reason IS DISTINCT FROM $2
+			AND created_at > NOW() - $3 * INTERVAL '1 second'`, column)+since,
+		value, reasonThrottled, int(loginWindow.Seconds())).Scan(&failures, &sinceLast)
+	if err != nil {
+		return 0, err
+	}
+	return backoffWait(failures, maxFailures, time.Duration(sinceLast.Float64*float64(time.Second))), nil
+}
+
+// the wait left after failures, the last of them elapsed ago
+func backoffWait(failures, maxFailures int, elapsed time.Duration) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	wait := loginLockout
+	if failures < maxFailures {
+		wait = time.Duration(float64(loginBackoffBase) * math.Pow(2, float64(failures-1)))
+		wait = min(wait, loginLockout)
+	}
+	if elapsed >= wait {
+		return 0
+	}
+	return wait - elapsed
+}
+
+func writeRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// record a login attempt, failures are also written to the log for auditing
+func recordLoginAttempt(db *sql.DB, username, ip string, success bool, reason string) {
+	var nullableReason sql.NullString
+	if reason != "" {
+		nullableReason = sql.NullString{String: reason, Valid: true}
+	}
+
+	_, err := db.Exec(`INSERT INTO login_attempts (username, ip, success, reason) VALUES ($1, $2, $3, $4)`,
+		username, ip, success, nullableReason)
+	if err != nil {
+		log.Printf("Failed to record login attempt: %s", err.Error())
+	}
+	if !success {
+		log.Printf("failed login for %q from %s: %s", username, ip, reason)
+	}
+}
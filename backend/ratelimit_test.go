@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffWait(t *testing.T) {
+	defer func(base, lockout time.Duration) {
+		loginBackoffBase, loginLockout = base, lockout
+	}(loginBackoffBase, loginLockout)
+	loginBackoffBase, loginLockout = time.Second, 15*time.Minute
+
+	tests := []struct {
+		name     string
+		failures int
+		elapsed  time.Duration
+		want     time.Duration
+	}{
+		{"no failures", 0, 0, 0},
+		{"first failure", 1, 0, time.Second},
+		{"second failure", 2, 0, 2 * time.Second},
+		{"fourth failure", 4, 0, 8 * time.Second},
+		{"part of the wait elapsed", 4, 3 * time.Second, 5 * time.Second},
+		{"wait elapsed", 4, 8 * time.Second, 0},
+		{"locked out at the limit", 5, 0, 15 * time.Minute},
+		{"lockout partly elapsed", 6, time.Minute, 14 * time.Minute},
+		{"lockout elapsed", 5, 15 * time.Minute, 0},
+	}
+	for _, tt := range tests {
+		if got := backoffWait(tt.failures, 5, tt.elapsed); got != tt.want {
+			t.Errorf("%s: backoffWait(%d, 5, %v) = %v, want %v", tt.name, tt.failures, tt.elapsed, got, tt.want)
+		}
+	}
+
+	// the doubling never goes past the lockout, even before the limit is reached
+	loginLockout = 10 * time.Second
+	if got := backoffWait(8, 20, 0); got != 10*time.Second {
+		t.Errorf("backoffWait(8, 20, 0) = %v, want the 10s lockout", got)
+	}
+}
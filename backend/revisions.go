@@ -0,0 +1,508 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// diffs whose changed lines would need a table of more than this many line pairs, 4 MB,
+// show those lines as replaced
+const maxDiffCells = 1_000_000
+
+// an immutable snapshot of a work, written after every change to it
+type WorkRevision struct {
+	Id           int             `json:"id"`
+	WorkId       int             `json:"work_id"`
+	Revision     int             `json:"revision"`
+	Title        string          `json:"title"`
+	Author       string          `json:"author"`
+	Category     string          `json:"category"`
+	ContentType  string          `json:"content_type"`
+	Content      *string         `json:"content,omitempty"`
+	Images       []RevisionImage `json:"images,omitempty"`
+	UserId       *int            `json:"user_id,omitempty"`
+	Username     *string         `json:"username,omitempty"`
+	RestoredFrom *int            `json:"restored_from,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// an image as a revision refers to it, stored as json in work_revisions.images
+type RevisionImage struct {
+	Path     string            `json:"path"`
+	URL      string            `json:"url,omitempty"`
+	Caption  string            `json:"caption"`
+	Alt      string            `json:"alt"`
+	Exif     *ImageExif        `json:"exif,omitempty"`
+	Variants []RevisionVariant `json:"variants,omitempty"`
+}
+
+type RevisionVariant struct {
+	Size        string `json:"size"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Path        string `json:"path"`
+	URL         string `json:"url,omitempty"`
+}
+
+// lock a work for a change that will be recorded as a revision. works created before
+// revisions existed get their current state recorded first, so the change can be undone
+func beginRevision(tx *sql.Tx, store Storage, workID interface{}) error {
+	var hasRevisions bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM work_revisions WHERE work_id = w.id)
+		FROM works w WHERE w.id = $1 FOR UPDATE`, workID).Scan(&hasRevisions)
+	if err != nil || hasRevisions {
+		return err
+	}
+	_, err = recordRevision(tx, store, workID, nil, nil)
+	return err
+}
+
+// snapshot the current state of a work as its next revision
+func recordRevision(tx *sql.Tx, store Storage, workID interface{}, user *User, restoredFrom *int) (int, error) {
+	var work Work
+	var content sql.NullString
+	err := tx.QueryRow(`
+		SELECT w.id, w.title, w.author, w.category, w.content_type, CASE WHEN w.content_type = 'text' THEN t.content END
+		FROM works w
+		LEFT JOIN texts t ON t.work_id = w.id
+		WHERE w.id = $1`, workID).Scan(&work.Id, &work.Title, &work.Author, &work.Category, &work.ContentType, &content)
+	if err != nil {
+		return 0, err
+	}
+	works := []Work{work}
+	if err := attachImages(tx, store, works); err != nil {
+		return 0, err
+	}
+
+	// files lists every key the revision needs, so they outlive the images rows
+	images, files := []RevisionImage{}, []string{}
+	for _, img := range works[0].Images {
+		ri := RevisionImage{Path: img.path, Caption: img.Caption, Alt: img.Alt, Exif: img.Exif}
+		files = append(files, img.path)
+		for _, v := range img.Variants {
+			ri.Variants = append(ri.Variants, RevisionVariant{v.Size, v.ContentType, v.Width, v.Height, v.path, ""})
+			files = append(files, v.path)
+		}
+		images = append(images, ri)
+	}
+	imagesJSON, err := json.Marshal(images)
+	if err != nil {
+		return 0, err
+	}
+
+	var userID *int
+	if user != nil {
+		userID = &user.Id
+	}
+	var revision int
+	err = tx.QueryRow(`
+		INSERT INTO work_revisions (work_id, revision, title, author, category, content_type, content, images, files, user_id, restored_from)
+		VALUES ($1, (SELECT COALESCE(MAX(revision), 0) + 1 FROM work_revisions WHERE work_id = $1), $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING revision`,
+		work.Id, work.Title, work.Author, work.Category, work.ContentType, content, imagesJSON, pq.Array(files), userID, restoredFrom).Scan(&revision)
+	return revision, err
+}
+
+func getRevision(db queryer, store Storage, workID string, revision int) (*WorkRevision, error) {
+	var rev WorkRevision
+	var imagesJSON []byte
+	err := db.QueryRow(`
+		SELECT r.id, r.work_id, r.revision, r.title, r.author, r.category, r.content_type, r.content, r.images,
+			r.user_id, u.username, r.restored_from, r.created_at
+		FROM work_revisions r
+		LEFT JOIN users u ON u.id = r.user_id
+		WHERE r.work_id = $1 AND r.revision = $2`, workID, revision).Scan(
+		&rev.Id, &rev.WorkId, &rev.Revision, &rev.Title, &rev.Author, &rev.Category, &rev.ContentType, &rev.Content, &imagesJSON,
+		&rev.UserId, &rev.Username, &rev.RestoredFrom, &rev.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(imagesJSON, &rev.Images); err != nil {
+		return nil, err
+	}
+	for i := range rev.Images {
+		img := &rev.Images[i]
+		img.URL = store.URL(img.Path)
+		for j := range img.Variants {
+			img.Variants[j].URL = store.URL(img.Variants[j].Path)
+		}
+	}
+	return &rev, nil
+}
+
+// revision number from the route, writing the error response if it isn't one
+func revisionParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	revision, err := strconv.Atoi(mux.Vars(r)["rev"])
+	if err != nil || revision < 1 {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return 0, false
+	}
+	return revision, true
+}
+
+// list the revisions of a work, newest first, without their content
+func getWorkRevisions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT r.id, r.work_id, r.revision, r.title, r.author, r.category, r.content_type,
+				r.user_id, u.username, r.restored_from, r.created_at
+			FROM work_revisions r
+			LEFT JOIN users u ON u.id = r.user_id
+			WHERE r.work_id = $1
+			ORDER BY r.revision DESC`, id)
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		revisions := []WorkRevision{}
+		for rows.Next() {
+			var rev WorkRevision
+			if err := rows.Scan(&rev.Id, &rev.WorkId, &rev.Revision, &rev.Title, &rev.Author, &rev.Category, &rev.ContentType,
+				&rev.UserId, &rev.Username, &rev.RestoredFrom, &rev.CreatedAt); err != nil {
+				http.Error(w, "Error scanning revisions: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			revisions = append(revisions, rev)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(revisions)
+	}
+}
+
+// a single revision with its content and images
+func getWorkRevision(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+		revision, ok := revisionParam(w, r)
+		if !ok {
+			return
+		}
+
+		rev, err := getRevision(db, store, id, revision)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Revision not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error retrieving revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rev)
+	}
+}
+
+type fieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type diffLine struct {
+	Op   string `json:"op"` // "equal", "insert" or "delete"
+	Text string `json:"text"`
+}
+
+type revisionDiff struct {
+	From    int                    `json:"from"`
+	To      int                    `json:"to"`
+	Changes map[string]fieldChange `json:"changes"`
+	Content []diffLine             `json:"content,omitempty"`
+}
+
+// compare a revision with the one given by ?against=, the previous revision by default.
+// fields that changed are listed with both values, text content as a line diff
+func diffWorkRevisions(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+		revision, ok := revisionParam(w, r)
+		if !ok {
+			return
+		}
+		against := revision - 1
+		if v := r.URL.Query().Get("against"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid revision to compare against", http.StatusBadRequest)
+				return
+			}
+			against = n
+		}
+
+		to, err := getRevision(db, store, id, revision)
+		// the first revision is compared against an empty work
+		from := &WorkRevision{}
+		if err == nil && against > 0 {
+			from, err = getRevision(db, store, id, against)
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "Revision not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Error retrieving revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		diff := revisionDiff{From: from.Revision, To: to.Revision, Changes: map[string]fieldChange{}}
+		for _, f := range []struct {
+			name     string
+			from, to string
+		}{
+			{"title", from.Title, to.Title},
+			{"author", from.Author, to.Author},
+			{"category", from.Category, to.Category},
+			{"content_type", from.ContentType, to.ContentType},
+		} {
+			if f.from != f.to {
+				diff.Changes[f.name] = fieldChange{f.from, f.to}
+			}
+		}
+		if !slices.EqualFunc(from.Images, to.Images, sameRevisionImage) {
+			diff.Changes["images"] = fieldChange{from.Images, to.Images}
+		}
+
+		var fromContent, toContent string
+		if from.Content != nil {
+			fromContent = *from.Content
+		}
+		if to.Content != nil {
+			toContent = *to.Content
+		}
+		if fromContent != toContent {
+			diff.Changes["content"] = fieldChange{from.Content, to.Content}
+			diff.Content = diffLines(splitLines(fromContent), splitLines(toContent))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+	}
+}
+
+func sameRevisionImage(a, b RevisionImage) bool {
+	return a.Path == b.Path && a.Caption == b.Caption && a.Alt == b.Alt
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+}
+
+// line diff from the longest common subsequence of a and b. lines shared at the start and
+// end are matched first, the table only covers the lines in between
+func diffLines(a, b []string) []diffLine {
+	var lines []diffLine
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		lines = append(lines, diffLine{"equal", a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	lines = append(lines, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, l := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{"equal", l})
+	}
+	return lines
+}
+
+func diffMiddle(a, b []string) []diffLine {
+	var lines []diffLine
+	// checked before allocating, a large body is shown as replaced as a whole
+	if len(a)*len(b) > maxDiffCells {
+		for _, l := range a {
+			lines = append(lines, diffLine{"delete", l})
+		}
+		for _, l := range b {
+			lines = append(lines, diffLine{"insert", l})
+		}
+		return lines
+	}
+
+	// lcs[i*width+j] is the length of the common subsequence of a[i:] and b[j:]
+	width := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*width)
+	at := func(i, j int) int32 { return lcs[i*width+j] }
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*width+j] = at(i+1, j+1) + 1
+			} else {
+				lcs[i*width+j] = max(at(i+1, j), at(i, j+1))
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{"equal", a[i]})
+			i++
+			j++
+		case at(i+1, j) >= at(i, j+1):
+			lines = append(lines, diffLine{"delete", a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{"insert", b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{"delete", a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{"insert", b[j]})
+	}
+	return lines
+}
+
+// put a work back the way an old revision recorded it. the restore is itself recorded as a
+// new revision, so nothing in the history is lost and a restore can be undone the same way
+func restoreWorkRevision(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if !authorizeWork(db, w, r, id) {
+			return
+		}
+		revision, ok := revisionParam(w, r)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := beginRevision(tx, store, id); err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rev, err := getRevision(tx, store, id, revision)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			http.Error(w, "Revision not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			http.Error(w, "Error retrieving revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var categoryType string
+		err = tx.QueryRow(`SELECT content_type FROM categories WHERE slug = $1`, rev.Category).Scan(&categoryType)
+		if err == sql.ErrNoRows || (err == nil && categoryType != rev.ContentType) {
+			tx.Rollback()
+			http.Error(w, "The category of this revision no longer exists or holds other content", http.StatusConflict)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to fetch category: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		_, err = tx.Exec(`UPDATE works SET title = $1, author = $2, content_type = $3, category = $4, updated_at = NOW() WHERE id = $5`,
+			rev.Title, rev.Author, rev.ContentType, rev.Category, id)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to update work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if rev.ContentType == "text" {
+			_, err = tx.Exec(`DELETE FROM texts WHERE work_id = $1`, id)
+			if err == nil {
+				_, err = tx.Exec(`INSERT INTO texts (work_id, content) VALUES ($1, COALESCE($2, ''))`, id, rev.Content)
+			}
+			if err != nil {
+				tx.Rollback()
+				http.Error(w, "Failed to restore text content: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// the current images are replaced by the ones of the revision, whose files are
+		// still in storage because the revision refers to them
+		oldFiles, err := imageFiles(tx, "i.work_id = $1", id)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM images WHERE work_id = $1`, id)
+		}
+		for _, ri := range rev.Images {
+			if err != nil {
+				break
+			}
+			img := &storedImage{key: ri.Path, caption: ri.Caption, alt: ri.Alt, exif: ri.Exif}
+			for _, v := range ri.Variants {
+				img.variants = append(img.variants, ImageVariant{Size: v.Size, ContentType: v.ContentType, Width: v.Width, Height: v.Height, path: v.Path})
+			}
+			_, err = insertImage(tx, id, img)
+		}
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to restore images: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		restored, err := recordRevision(tx, store, id, currentUser(r), &revision)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to record revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		deleteUnreferencedFiles(r.Context(), db, store, oldFiles)
+
+		rev, err = getRevision(db, store, id, restored)
+		if err != nil {
+			http.Error(w, "Error retrieving revision: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rev)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string // one line per diffLine, prefixed with " ", "-" or "+"
+	}{
+		{"both empty", "", "", ""},
+		{"unchanged", "a\nb", "a\nb", " a  b"},
+		{"added", "", "a\nb", "+a +b"},
+		{"removed", "a\nb", "", "-a -b"},
+		{"changed line", "a\nb\nc", "a\nx\nc", " a -b +x  c"},
+		{"inserted in the middle", "a\nc", "a\nb\nc", " a +b  c"},
+		{"moved line", "a\nb\nc", "b\nc\na", "-a  b  c +a"},
+		{"windows line endings", "a\r\nb", "a\nb", " a  b"},
+	}
+	for _, tt := range tests {
+		if got := formatDiff(diffLines(splitLines(tt.a), splitLines(tt.b))); got != tt.want {
+			t.Errorf("%s: diffLines = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffLinesCutoff(t *testing.T) {
+	// a shared first and last line around two bodies with no line in common
+	var a, b []string
+	side := 1001 // side*side is just over maxDiffCells
+	for i := range side {
+		a = append(a, fmt.Sprint("old ", i))
+		b = append(b, fmt.Sprint("new ", i))
+	}
+	// one line in common that an lcs would match, the cutoff replaces the body as a whole
+	a[side/2], b[side/2] = "same", "same"
+	a = append(append([]string{"first"}, a...), "last")
+	b = append(append([]string{"first"}, b...), "last")
+
+	lines := diffLines(a, b)
+	var ops []string
+	for _, l := range lines {
+		if len(ops) == 0 || ops[len(ops)-1] != l.Op {
+			ops = append(ops, l.Op)
+		}
+	}
+	if want := []string{"equal", "delete", "insert", "equal"}; !slices.Equal(ops, want) {
+		t.Errorf("diffLines over maxDiffCells has runs %v, want %v", ops, want)
+	}
+	if len(lines) != 2+2*side {
+		t.Errorf("diffLines over maxDiffCells has %d lines, want %d", len(lines), 2+2*side)
+	}
+
+	// just under the cutoff the common line is still found
+	lines = diffLines(a[:side], b[:side])
+	if !slices.Contains(lines, diffLine{"equal", "same"}) {
+		t.Error("diffLines under maxDiffCells did not match the common line")
+	}
+}
+
+func formatDiff(lines []diffLine) string {
+	prefixes := map[string]string{"equal": " ", "delete": "-", "insert": "+"}
+	var parts []string
+	for _, l := range lines {
+		parts = append(parts, prefixes[l.Op]+l.Text)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+type permission string
+
+const (
+	permViewDrafts       permission = "works:view_drafts" // every draft, not just the user's own
+	permWriteWorks       permission = "works:write"       // create works and edit own drafts
+	permEditAnyWork      permission = "works:edit_any"    // edit works owned by others and published works
+	permPublishWorks     permission = "works:publish"     // publish and unpublish works
+	permDeleteWorks      permission = "works:delete"
+	permManageUsers      permission = "users:manage"
+	permManageCategories permission = "categories:manage"
+)
+
+var roles = []string{"admin", "editor", "viewer"}
+
+var rolePermissions = map[string][]permission{
+	"admin":  {permViewDrafts, permWriteWorks, permEditAnyWork, permPublishWorks, permDeleteWorks, permManageUsers, permManageCategories},
+	"editor": {permWriteWorks},
+	"viewer": {permViewDrafts},
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func hasPermission(u *User, p permission) bool {
+	if u == nil {
+		return false
+	}
+	for _, granted := range rolePermissions[u.Role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// reject requests whose user lacks the permission, must be wrapped by authenticate
+func requirePermission(p permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasPermission(currentUser(r), p) {
+			http.Error(w, "You do not have permission to do this", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// change a user's role, bumping the token version so tokens carrying the old role stop working.
+// refresh tokens stay valid and pick up the new role on their next rotation
+func setRole(db *sql.DB, username, role string) error {
+	if !validRole(role) {
+		return fmt.Errorf("role must be one of %v", roles)
+	}
+
+	res, err := db.Exec(`UPDATE users SET role = $1, token_version = token_version + 1, updated_at = NOW()
+		WHERE username = $2`, role, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %q not found", username)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// tsvector expressions of the search query, they must match the GIN indexes in
+// migrations/0002_search_indexes.up.sql exactly for postgres to use them.
+// the 'simple' configuration keeps poems in any language searchable
+const (
+	worksSearchVector = `setweight(to_tsvector('simple', title), 'A') || setweight(to_tsvector('simple', author), 'B')`
+	textsSearchVector = `setweight(to_tsvector('simple', content), 'C')`
+
+	// ts_headline marks matches with private use characters rather than html, the text around
+	// them is escaped before the marks become <mark> tags. the characters are removed from the
+	// content first so a work can't forge a mark
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+
+	titleHeadlineOptions = `StartSel=` + highlightStart + `, StopSel=` + highlightStop + `, HighlightAll=true`
+	headlineOptions      = `StartSel=` + highlightStart + `, StopSel=` + highlightStop + `, MinWords=10, MaxWords=30, MaxFragments=2`
+)
+
+var highlightTags = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+
+// an sql expression of the text without highlight marks
+func withoutHighlightMarks(expr string) string {
+	return "translate(" + expr + ", '" + highlightStart + highlightStop + "', '')"
+}
+
+// html of a ts_headline result, the user's text escaped and the matches wrapped in <mark>
+func highlightHTML(headline string) string {
+	return highlightTags.Replace(html.EscapeString(headline))
+}
+
+// title_highlight and snippet are safe html, escaped text with the matches in <mark> tags
+type SearchResult struct {
+	Work
+	Rank           float64 `json:"rank"`
+	TitleHighlight string  `json:"title_highlight"`
+	Snippet        string  `json:"snippet"`
+}
+
+type SearchPage struct {
+	Results []SearchResult `json:"results"`
+	Total   int            `json:"total"`
+}
+
+// full-text search over titles, authors and text content, drafts are only searched by their owners and users allowed to view drafts
+func searchWorks(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			http.Error(w, "Search query is required", http.StatusBadRequest)
+			return
+		}
+
+		limit, offset := defaultPageLimit, 0
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxPageLimit)
+		}
+		if v := r.URL.Query().Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			offset = n
+		}
+
+		var filter workFilter
+		filter.add("(("+worksSearchVector+") @@ websearch_to_tsquery('simple', ?) OR ("+
+			textsSearchVector+") @@ websearch_to_tsquery('simple', ?))", q, q)
+		filter.add("w.deleted_at IS NULL")
+		if user := optionalUser(db, r); user == nil {
+			filter.add("w.is_published = TRUE")
+		} else if !hasPermission(user, permViewDrafts) {
+			filter.add("(w.is_published = TRUE OR w.user_id = ?)", user.Id)
+		}
+
+		from := ` FROM works w LEFT JOIN texts t ON w.id = t.work_id`
+
+		page := SearchPage{Results: []SearchResult{}}
+		if err := db.QueryRow(`SELECT COUNT(*)`+from+filter.where(), filter.args...).Scan(&page.Total); err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// the search terms are the last argument so the rank and headline expressions can refer to it
+		args := append(filter.args, q)
+		query := `
+			SELECT w.id, w.title, w.author, w.content_type, w.category, w.created_at, w.updated_at, w.is_published,
+				ts_rank((` + worksSearchVector + `) || COALESCE(` + textsSearchVector + `, ''), query) AS rank,
+				ts_headline('simple', ` + withoutHighlightMarks("w.title") + `, query, '` + titleHeadlineOptions + `'),
+				ts_headline('simple', ` + withoutHighlightMarks("COALESCE(t.content, w.title)") + `, query, '` + headlineOptions + `')
+			FROM works w
+			LEFT JOIN texts t ON w.id = t.work_id
+			CROSS JOIN websearch_to_tsquery('simple', $` + strconv.Itoa(len(args)) + `) query` +
+			filter.where() + `
+			ORDER BY rank DESC, w.id DESC
+			LIMIT ` + strconv.Itoa(limit) + ` OFFSET ` + strconv.Itoa(offset)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var result SearchResult
+			if err := rows.Scan(&result.Id, &result.Title, &result.Author, &result.ContentType, &result.Category,
+				&result.CreatedAt, &result.UpdatedAt, &result.IsPublished,
+				&result.Rank, &result.TitleHighlight, &result.Snippet); err != nil {
+				http.Error(w, "Error scanning row: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.TitleHighlight = highlightHTML(result.TitleHighlight)
+			result.Snippet = highlightHTML(result.Snippet)
+			page.Results = append(page.Results, result)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
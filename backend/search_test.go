@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestHighlightHTML(t *testing.T) {
+	tests := []struct {
+		name, headline, want string
+	}{
+		{"plain text", "a quiet study", "a quiet study"},
+		{"match", "a " + highlightStart + "quiet" + highlightStop + " study", "a <mark>quiet</mark> study"},
+		{"markup in the text", `<script>alert("x")</script>`, "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;"},
+		{"markup inside a match", highlightStart + "<b>" + highlightStop + " & 'b'", "<mark>&lt;b&gt;</mark> &amp; &#39;b&#39;"},
+		{"literal mark tags stay escaped", "<mark>fake</mark>", "&lt;mark&gt;fake&lt;/mark&gt;"},
+	}
+	for _, tt := range tests {
+		if got := highlightHTML(tt.headline); got != tt.want {
+			t.Errorf("%s: highlightHTML = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
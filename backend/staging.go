@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staged files live under this prefix until the transaction recording them commits
+const stagingPrefix = "staging/"
+
+// a Storage whose writes go to the staging area. handlers write files before their transaction
+// commits, so a rollback or a crash leaves staged files behind for fsck rather than files that
+// look like live uploads. the move to the real key happens in commit, after tx.Commit.
+// content addressed keys are shared by uploads of the same bytes, so every request stages
+// under its own directory and never touches another request's files
+type stagedStore struct {
+	Storage
+	dir    string
+	staged []string
+}
+
+func stageWrites(store Storage) *stagedStore {
+	id, err := randomHex(16)
+	if err != nil {
+		// the os random source is broken, the clock still keeps requests apart
+		id = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return &stagedStore{Storage: store, dir: stagingPrefix + id + "/"}
+}
+
+func (s *stagedStore) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	if err := s.Storage.Put(ctx, s.dir+key, r, contentType); err != nil {
+		return err
+	}
+	s.staged = append(s.staged, key)
+	return nil
+}
+
+// move the staged files to their keys once the transaction has committed. the rows already point
+// at the keys, so a failed move is logged and left for `api storage fsck --repair` to finish
+func (s *stagedStore) commit(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range s.staged {
+		if err := s.Storage.Rename(ctx, s.dir+key, key); err != nil {
+			log.Printf("Failed to move staged file %s into place: %s", key, err.Error())
+		}
+	}
+	s.staged = nil
+}
+
+// remove whatever this request still has staged, deferred by handlers so every early return is covered
+func (s *stagedStore) rollback(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range s.staged {
+		if err := s.Storage.Delete(ctx, s.dir+key); err != nil {
+			log.Printf("Failed to delete staged file %s: %s", key, err.Error())
+		}
+	}
+	s.staged = nil
+}
+
+// the key a staged object is moved to, from staging/<request>/<key> or the staging/<key> of
+// files staged before requests had their own directory
+func stagedKey(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, stagingPrefix)
+	if !ok {
+		return "", false
+	}
+	if _, key, ok := strings.Cut(rest, "/"); ok {
+		return key, true
+	}
+	return rest, true
+}
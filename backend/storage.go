@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// where uploaded files live. keys are slash separated relative names, the sha-256 of the
+// content and an extension for new files. images.image_path stores keys rather than locations
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// move an object to another key, atomically where the backend allows it
+	Rename(ctx context.Context, from, to string) error
+	// every object in storage, used by fsck
+	List(ctx context.Context) ([]StoredObject, error)
+	URL(key string) string
+}
+
+// an object found by Storage.List
+type StoredObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// pick the storage backend from STORAGE_BACKEND, local disk by default
+func newStorage() (Storage, error) {
+	publicURL := os.Getenv("STORAGE_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8000/uploads/"
+	}
+
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "/frontend/public/works"
+		}
+		return &LocalStorage{root: dir, publicURL: publicURL}, nil
+	case "s3":
+		return newS3Storage(publicURL)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// keys come from the database and request paths, refuse anything that could escape the storage root
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	return path.Clean(key) == key && !strings.HasPrefix(key, "../") && key != ".."
+}
+
+// files in a directory on the local disk
+type LocalStorage struct {
+	root      string
+	publicURL string
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	out, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(p)
+		return err
+	}
+	return out.Close()
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.removeEmptyDirs(filepath.Dir(p))
+	return nil
+}
+
+// remove dir and its parents below the root while they are empty, every request stages its files
+// in a directory of its own. os.Remove refuses directories that still hold files
+func (s *LocalStorage) removeEmptyDirs(dir string) {
+	root := filepath.Clean(s.root)
+	for strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// os.Rename replaces the target atomically as long as both paths are on the same filesystem,
+// which they are since staged files live under the same root
+func (s *LocalStorage) Rename(ctx context.Context, from, to string) error {
+	src, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	s.removeEmptyDirs(filepath.Dir(src))
+	return nil
+}
+
+func (s *LocalStorage) List(ctx context.Context) ([]StoredObject, error) {
+	var objects []StoredObject
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && p == s.root {
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, StoredObject{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return s.publicURL + key
+}
+
+// the content type of a stored file from its extension, the types uploads are accepted as come first
+func uploadContentType(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	for contentType, e := range imageExtensions {
+		if e == ext {
+			return contentType
+		}
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// serve stored files under /uploads/ whatever the backend is
+func serveUploads(store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/uploads/")
+		if !validKey(key) || strings.HasPrefix(key, stagingPrefix) {
+			http.NotFound(w, r)
+			return
+		}
+
+		// a content addressed file never changes, its hash is a strong etag and it can be cached
+		// for good. files named before content addressing may still be replaced in place.
+		// errors aren't cached
+		cache := uploadCacheControl
+		if hash := contentHash(key); hash != "" {
+			cache = immutableCacheControl
+			if notModified(&cacheControlWriter{ResponseWriter: w, value: cache}, r, `"`+hash+`"`, time.Time{}) {
+				return
+			}
+		}
+
+		body, err := store.Get(r.Context(), key)
+		if err == errObjectNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to read file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Cache-Control", cache)
+		w.Header().Set("Content-Type", uploadContentType(key))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.Copy(w, body)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// objects in an S3-compatible bucket (AWS, MinIO, R2, ...), requests are signed with SigV4
+type S3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	publicURL string
+	client    *http.Client
+}
+
+// configured by S3_ENDPOINT, S3_BUCKET, S3_REGION, S3_ACCESS_KEY, S3_SECRET_KEY and S3_PATH_STYLE
+func newS3Storage(publicURL string) (*S3Storage, error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+
+	s := &S3Storage{
+		endpoint:  u,
+		bucket:    os.Getenv("S3_BUCKET"),
+		region:    os.Getenv("S3_REGION"),
+		accessKey: os.Getenv("S3_ACCESS_KEY"),
+		secretKey: os.Getenv("S3_SECRET_KEY"),
+		// MinIO and most self-hosted stand-ins only understand path-style addressing
+		pathStyle: os.Getenv("S3_PATH_STYLE") != "false",
+		publicURL: publicURL,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for the s3 storage backend")
+	}
+	return s, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	// the payload hash is part of the signature, so the body is buffered
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(ctx, http.MethodPut, key, body, contentType, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s.responseError(res)
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s.responseError(res)
+	}
+	return res.Body, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, "", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// deleting a missing object succeeds with 204 on S3
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s.responseError(res)
+	}
+	return nil
+}
+
+// S3 has no rename, the object is copied server side and the source deleted. readers of the
+// target never see a partial object, the source lingers if the delete fails
+func (s *S3Storage) Rename(ctx context.Context, from, to string) error {
+	if !validKey(from) {
+		return fmt.Errorf("invalid storage key %q", from)
+	}
+	res, err := s.do(ctx, http.MethodPut, to, nil, "", map[string]string{
+		"x-amz-copy-source": uriEncode("/" + s.bucket + "/" + from),
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s.responseError(res)
+	}
+	// a copy can fail after the 200 status was sent, the error is then in the body
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("s3 copy of %s failed: %s", from, strings.TrimSpace(string(body)))
+	}
+	return s.Delete(ctx, from)
+}
+
+// page through ListObjectsV2
+func (s *S3Storage) List(ctx context.Context) ([]StoredObject, error) {
+	var objects []StoredObject
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.bucketURL()
+		// SigV4 wants %20 rather than + for spaces in the canonical query
+		u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+		res, err := s.send(ctx, http.MethodGet, u, nil, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			defer res.Body.Close()
+			return nil, s.responseError(res)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			objects = append(objects, StoredObject{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) URL(key string) string {
+	return s.publicURL + key
+}
+
+func (s *S3Storage) responseError(res *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3 request failed with %s: %s", res.Status, strings.TrimSpace(string(msg)))
+}
+
+// bucket location for path-style (endpoint/bucket) or virtual-hosted (bucket.endpoint) addressing
+func (s *S3Storage) bucketURL() *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/"
+	}
+	return &u
+}
+
+// object location below the bucket
+func (s *S3Storage) objectURL(key string) *url.URL {
+	u := s.bucketURL()
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = uriEncode(u.Path)
+	return u
+}
+
+func (s *S3Storage) do(ctx context.Context, method, key string, body []byte, contentType string, headers map[string]string) (*http.Response, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+	return s.send(ctx, method, s.objectURL(key), body, contentType, headers)
+}
+
+func (s *S3Storage) send(ctx context.Context, method string, u *url.URL, body []byte, contentType string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// add an AWS Signature Version 4 Authorization header, signing the host and every x-amz- header.
+// the query must already be in canonical form, sorted and percent-encoded
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	names := []string{"host"}
+	for name := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders += name + ":" + value + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SigV4 path encoding: everything but unreserved characters and slashes is percent-encoded
+func uriEncode(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxTagLength   = 50
+	maxTagsPerWork = 20
+)
+
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// split comma separated tag values, lowercased with inner whitespace turned into dashes
+// so "Glitch Art" and "glitch-art" are the same tag. duplicates are dropped
+func parseTags(values []string) ([]string, error) {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.ToLower(strings.Join(strings.Fields(tag), "-"))
+			if tag == "" || seen[tag] {
+				continue
+			}
+			if len(tag) > maxTagLength {
+				return nil, fmt.Errorf("tags must be at most %d characters long", maxTagLength)
+			}
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTagsPerWork {
+		return nil, fmt.Errorf("a work can have at most %d tags", maxTagsPerWork)
+	}
+	return tags, nil
+}
+
+// replace the tags of a work, creating tags that don't exist yet
+func setWorkTags(tx *sql.Tx, workID interface{}, tags []string) error {
+	if _, err := tx.Exec(`DELETE FROM work_tags WHERE work_id = $1`, workID); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING`, pq.Array(tags)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO work_tags (work_id, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2)`, workID, pq.Array(tags))
+	return err
+}
+
+// filter works by the tag query parameters, ?tag=a&tag=b or ?tag=a,b. works need every tag
+// unless tag_mode=any, then one of them is enough
+func addTagFilter(filter *workFilter, r *http.Request) error {
+	q := r.URL.Query()
+	tags, err := parseTags(q["tag"])
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	switch q.Get("tag_mode") {
+	case "", "all":
+		filter.add(`id IN (SELECT wt.work_id FROM work_tags wt JOIN tags t ON t.id = wt.tag_id
+			WHERE t.name = ANY(?) GROUP BY wt.work_id HAVING COUNT(*) = ?)`, pq.Array(tags), len(tags))
+	case "any":
+		filter.add(`id IN (SELECT wt.work_id FROM work_tags wt JOIN tags t ON t.id = wt.tag_id
+			WHERE t.name = ANY(?))`, pq.Array(tags))
+	default:
+		return errors.New("tag_mode must be all or any")
+	}
+	return nil
+}
+
+// fill in the tags of works
+func attachTags(db *sql.DB, works []Work) error {
+	if len(works) == 0 {
+		return nil
+	}
+	byID := map[int]*Work{}
+	ids := make([]int64, len(works))
+	for i := range works {
+		works[i].Tags = []string{}
+		byID[works[i].Id] = &works[i]
+		ids[i] = int64(works[i].Id)
+	}
+
+	rows, err := db.Query(`
+		SELECT wt.work_id, t.name
+		FROM work_tags wt
+		JOIN tags t ON t.id = wt.tag_id
+		WHERE wt.work_id = ANY($1)
+		ORDER BY t.name`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var workID int
+		var name string
+		if err := rows.Scan(&workID, &name); err != nil {
+			return err
+		}
+		work := byID[workID]
+		work.Tags = append(work.Tags, name)
+	}
+	return rows.Err()
+}
+
+// tag cloud: every tag used by a published work with how many published works carry it,
+// optionally limited to ?category=
+func getTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter workFilter
+		filter.add("w.is_published = TRUE")
+		filter.add("w.deleted_at IS NULL")
+		if category := r.URL.Query().Get("category"); category != "" {
+			filter.add("w.category = ?", category)
+		}
+
+		rows, err := db.Query(`
+			SELECT t.name, COUNT(*)
+			FROM tags t
+			JOIN work_tags wt ON wt.tag_id = t.id
+			JOIN works w ON w.id = wt.work_id`+filter.where()+`
+			GROUP BY t.name
+			ORDER BY COUNT(*) DESC, t.name`, filter.args...)
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		tags := []TagCount{}
+		for rows.Next() {
+			var tag TagCount
+			if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+				http.Error(w, "Error scanning tags: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tags = append(tags, tag)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tags)
+	}
+}
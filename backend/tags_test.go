@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"nothing", nil, []string{}},
+		{"empty values", []string{"", " , ,"}, []string{}},
+		{"comma separated", []string{"glitch,pixel art"}, []string{"glitch", "pixel-art"}},
+		{"several values", []string{"glitch", "pixel art"}, []string{"glitch", "pixel-art"}},
+		{"lowercased", []string{"Glitch ART"}, []string{"glitch-art"}},
+		{"inner whitespace collapsed", []string{"  glitch \t  art  "}, []string{"glitch-art"}},
+		{"duplicates dropped in order", []string{"b, a", "Glitch Art", "glitch-art, B"}, []string{"b", "a", "glitch-art"}},
+	}
+	for _, tt := range tests {
+		got, err := parseTags(tt.values)
+		if err != nil {
+			t.Errorf("%s: parseTags(%q): %v", tt.name, tt.values, err)
+			continue
+		}
+		if got == nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%s: parseTags(%q) = %#v, want %#v", tt.name, tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestParseTagsLimits(t *testing.T) {
+	long := strings.Repeat("a", maxTagLength)
+	if _, err := parseTags([]string{long}); err != nil {
+		t.Errorf("parseTags of a %d character tag: %v", maxTagLength, err)
+	}
+	if _, err := parseTags([]string{long + "a"}); err == nil {
+		t.Errorf("parseTags accepted a %d character tag", maxTagLength+1)
+	}
+
+	var tags []string
+	for i := range maxTagsPerWork + 1 {
+		tags = append(tags, fmt.Sprint("tag", i))
+	}
+	if _, err := parseTags(tags[:maxTagsPerWork]); err != nil {
+		t.Errorf("parseTags of %d tags: %v", maxTagsPerWork, err)
+	}
+	if _, err := parseTags(tags); err == nil {
+		t.Errorf("parseTags accepted %d tags", len(tags))
+	}
+	// duplicates don't count towards the limit
+	if _, err := parseTags(append(tags[:maxTagsPerWork], "TAG0", "tag1")); err != nil {
+		t.Errorf("parseTags counted duplicates: %v", err)
+	}
+}
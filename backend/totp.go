@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RFC 6238 parameters understood by every common authenticator app
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1 // steps accepted on either side of the current one for clock drift
+	totpIssuer = "leidorf.space"
+
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var (
+	totpKey      = deriveTOTPKey()
+	base32NoPad  = base32.StdEncoding.WithPadding(base32.NoPadding)
+	errTOTPState = errors.New("two-factor authentication is not in the expected state")
+)
+
+// AES-256 key for totp secrets at rest, TOTP_ENCRYPTION_KEY falls back to the jwt secret
+func deriveTOTPKey() []byte {
+	key := os.Getenv("TOTP_ENCRYPTION_KEY")
+	if key == "" {
+		key = os.Getenv("JWT_SECRET_KEY")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+func encryptSecret(secret string) (string, error) {
+	block, err := aes.NewCipher(totpKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(totpKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// HOTP value (RFC 4226) of the raw secret for a time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// check a code against the steps around now, returning the matched step.
+// steps at or before lastStep were already used and are rejected
+func verifyTOTP(secretB32, code string, lastStep int64, now time.Time) (int64, bool) {
+	secret, err := base32NoPad.DecodeString(secretB32)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func provisioningURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// recovery codes are compared case-insensitively and without separators
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// replace the user's recovery codes with fresh ones, returning them in plain text once
+func generateRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = raw[:5] + "-" + raw[5:]
+		if _, err := tx.Exec(`INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashRecoveryCode(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// mark one of the user's unused recovery codes matching code as used, reporting whether there was one
+func useRecoveryCode(q execer, userID int, code string) (bool, error) {
+	res, err := q.Exec(`UPDATE totp_recovery_codes SET used_at = NOW()
+		WHERE id = (SELECT id FROM totp_recovery_codes WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL LIMIT 1)`,
+		userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// signed token proving the password step of a login, only accepted by loginTOTP
+func issueMFAToken(userID int, username string, version int) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      strconv.Itoa(userID),
+		"username": username,
+		"ver":      version,
+		"purpose":  "mfa",
+		"exp":      time.Now().Add(mfaTokenTTL).Unix(),
+	})
+	return token.SignedString(secretKey)
+}
+
+// start enrollment by generating a secret, it only takes effect once a code is confirmed
+func enrollTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+
+		var enabled bool
+		if err := db.QueryRow(`SELECT totp_enabled FROM users WHERE id = $1`, user.Id).Scan(&enabled); err != nil {
+			http.Error(w, "Failed to fetch user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if enabled {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+
+		raw := make([]byte, 20)
+		if _, err := rand.Read(raw); err != nil {
+			http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+		secret := base32NoPad.EncodeToString(raw)
+
+		encrypted, err := encryptSecret(secret)
+		if err != nil {
+			http.Error(w, "Failed to encrypt secret", http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.Exec(`UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2`, encrypted, user.Id); err != nil {
+			http.Error(w, "Failed to save secret: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret":           secret,
+			"provisioning_uri": provisioningURI(user.Username, secret),
+		})
+	}
+}
+
+// confirm enrollment with a code from the authenticator, returns the recovery codes
+func confirmTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var encrypted sql.NullString
+		var enabled bool
+		err = tx.QueryRow(`SELECT totp_secret, totp_enabled FROM users WHERE id = $1 FOR UPDATE`, user.Id).Scan(&encrypted, &enabled)
+		if err != nil {
+			http.Error(w, "Failed to fetch user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if enabled || !encrypted.Valid {
+			http.Error(w, errTOTPState.Error(), http.StatusConflict)
+			return
+		}
+
+		secret, err := decryptSecret(encrypted.String)
+		if err != nil {
+			http.Error(w, "Failed to decrypt secret", http.StatusInternalServerError)
+			return
+		}
+		step, ok := verifyTOTP(secret, strings.TrimSpace(req.Code), 0, time.Now())
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := tx.Exec(`UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE id = $2`, step, user.Id); err != nil {
+			http.Error(w, "Failed to enable two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		codes, err := generateRecoveryCodes(tx, user.Id)
+		if err != nil {
+			http.Error(w, "Failed to generate recovery codes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string][]string{
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// turn two-factor authentication off after re-checking the password
+func disableTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var storedPassword string
+		if err := db.QueryRow(`SELECT password FROM users WHERE id = $1`, user.Id).Scan(&storedPassword); err != nil {
+			http.Error(w, "Failed to fetch user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(req.Password)); err != nil {
+			http.Error(w, "Password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE id = $1`, user.Id); err != nil {
+			http.Error(w, "Failed to disable two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, user.Id); err != nil {
+			http.Error(w, "Failed to delete recovery codes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	}
+}
+
+// second login step, exchanges the mfa token from adminLogin and a totp or recovery code for tokens
+func loginTOTP(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		claims, err := parseJWT(req.MFAToken)
+		subject, ok := tokenSubject(claims)
+		if err != nil || claims["purpose"] != "mfa" || !ok {
+			http.Error(w, "Invalid or expired login, start again", http.StatusUnauthorized)
+			return
+		}
+		// the username only keys the login throttling, the user is looked up by id
+		username, _ := claims["username"].(string)
+		version, _ := claims["ver"].(float64)
+
+		ip := clientIP(r)
+		retryAfter, err := loginRetryAfter(db, username, ip)
+		if err != nil {
+			http.Error(w, "Failed to check login attempts: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if retryAfter > 0 {
+			recordLoginAttempt(db, username, ip, false, reasonThrottled)
+			writeRetryAfter(w, retryAfter)
+			http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var userID, tokenVersion int
+		var lastStep int64
+		var role string
+		var encrypted sql.NullString
+		err = tx.QueryRow(`SELECT id, role, token_version, totp_secret, totp_last_step FROM users
+			WHERE id = $1 AND totp_enabled FOR UPDATE`, subject).Scan(
+			&userID, &role, &tokenVersion, &encrypted, &lastStep)
+		if err != nil || int(version) != tokenVersion || !encrypted.Valid {
+			http.Error(w, "Invalid or expired login, start again", http.StatusUnauthorized)
+			return
+		}
+
+		secret, err := decryptSecret(encrypted.String)
+		if err != nil {
+			http.Error(w, "Failed to decrypt secret", http.StatusInternalServerError)
+			return
+		}
+
+		code := strings.TrimSpace(req.Code)
+		if step, ok := verifyTOTP(secret, code, lastStep, time.Now()); ok {
+			_, err = tx.Exec(`UPDATE users SET totp_last_step = $1 WHERE id = $2`, step, userID)
+		} else {
+			// fall back to a single-use recovery code
+			var used bool
+			used, err = useRecoveryCode(tx, userID, code)
+			if err == nil && !used {
+				tx.Rollback()
+				recordLoginAttempt(db, username, ip, false, "wrong totp code")
+				http.Error(w, "Invalid code", http.StatusUnauthorized)
+				return
+			}
+		}
+		if err != nil {
+			http.Error(w, "Failed to verify code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tokens, err := issueTokens(tx, userID, username, role, tokenVersion, "")
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		recordLoginAttempt(db, username, ip, true, "")
+
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
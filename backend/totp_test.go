@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+// the SHA-1 seed of RFC 6238 appendix B, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// the SHA-1 test vectors of RFC 6238 appendix B, cut from 8 to the 6 digits apps show
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	secret, err := base32NoPad.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, _ := base32NoPad.DecodeString(rfcSecret)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	code := func(step int64) string { return totpCode(secret, step) }
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfcSecret, code(current), 0, current, true},
+		{"one step behind", rfcSecret, code(current - 1), 0, current - 1, true},
+		{"one step ahead", rfcSecret, code(current + 1), 0, current + 1, true},
+		{"two steps behind", rfcSecret, code(current - 2), 0, 0, false},
+		{"two steps ahead", rfcSecret, code(current + 2), 0, 0, false},
+		{"replayed step", rfcSecret, code(current), current, 0, false},
+		{"step before the last used one", rfcSecret, code(current - 1), current, 0, false},
+		{"step after the last used one", rfcSecret, code(current + 1), current, current + 1, true},
+		{"wrong code", rfcSecret, "000000", 0, 0, false},
+		{"too short", rfcSecret, code(current)[:5], 0, 0, false},
+		{"undecodable secret", "not base32!", code(current), 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(tt.secret, tt.code, tt.lastStep, now)
+		if ok != tt.wantOK || step != tt.wantStep {
+			t.Errorf("%s: verifyTOTP = %d, %v, want %d, %v", tt.name, step, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+func TestSecretEncryptionRoundTrip(t *testing.T) {
+	first, err := encryptSecret(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encryptSecret(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("encrypting twice gave the same ciphertext, the nonce is not random")
+	}
+	for _, encrypted := range []string{first, second} {
+		if got, err := decryptSecret(encrypted); err != nil || got != rfcSecret {
+			t.Errorf("decryptSecret = %q, %v, want %q", got, err, rfcSecret)
+		}
+	}
+
+	sealed, _ := base64.StdEncoding.DecodeString(first)
+	sealed[len(sealed)-1] ^= 1
+	tests := map[string]string{
+		"tampered":     base64.StdEncoding.EncodeToString(sealed),
+		"too short":    base64.StdEncoding.EncodeToString(sealed[:4]),
+		"not base64":   "%%%",
+		"empty string": "",
+	}
+	for name, encrypted := range tests {
+		if _, err := decryptSecret(encrypted); err == nil {
+			t.Errorf("%s: decryptSecret succeeded", name)
+		}
+	}
+}
+
+func TestRecoveryCodeNormalization(t *testing.T) {
+	want := hashRecoveryCode("abcde-12345")
+	for _, code := range []string{"ABCDE-12345", "abcde12345", " abcde 12345 ", "AbCdE - 12345"} {
+		if got := hashRecoveryCode(code); got != want {
+			t.Errorf("hashRecoveryCode(%q) differs from the hash of abcde-12345", code)
+		}
+	}
+	if hashRecoveryCode("abcde-12346") == want {
+		t.Error("a different code has the same hash")
+	}
+}
+
+// the totp_recovery_codes rows of one user, applying useRecoveryCode's update the way its
+// WHERE clause does: only a matching code that wasn't used yet is marked
+type fakeRecoveryCodes struct {
+	userID int
+	used   map[string]bool // by code hash
+}
+
+func (f *fakeRecoveryCodes) Exec(query string, args ...interface{}) (sql.Result, error) {
+	userID, hash := args[0].(int), args[1].(string)
+	used, ok := f.used[hash]
+	if userID != f.userID || !ok || used {
+		return driverResult(0), nil
+	}
+	f.used[hash] = true
+	return driverResult(1), nil
+}
+
+type driverResult int64
+
+func (r driverResult) LastInsertId() (int64, error) { return 0, nil }
+func (r driverResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	codes := &fakeRecoveryCodes{userID: 7, used: map[string]bool{
+		hashRecoveryCode("abcde-12345"): false,
+		hashRecoveryCode("fghij-67890"): false,
+	}}
+
+	steps := []struct {
+		name   string
+		userID int
+		code   string
+		want   bool
+	}{
+		{"first use", 7, "ABCDE-12345", true},
+		{"second use", 7, "abcde12345", false},
+		{"another user's code", 8, "fghij-67890", false},
+		{"unknown code", 7, "zzzzz-00000", false},
+		{"other code still works", 7, "fghij-67890", true},
+	}
+	for _, s := range steps {
+		used, err := useRecoveryCode(codes, s.userID, s.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != s.want {
+			t.Errorf("%s: useRecoveryCode = %v, want %v", s.name, used, s.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+var (
+	trashRetentionDays = envInt("TRASH_RETENTION_DAYS", 30)
+	trashPurgeInterval = envDuration("TRASH_PURGE_INTERVAL", time.Hour)
+)
+
+// works purged per transaction, the purge repeats until nothing is due
+const trashPurgeBatch = 100
+
+// list the works in the trash, newest first by default like the other listings
+func getTrash(db *sql.DB, store Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, err := parseWorkListParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var filter workFilter
+		filter.add("deleted_at IS NOT NULL")
+
+		page, err := queryWorkPage(db, filter, params)
+		if err == nil {
+			err = attachImages(db, store, page.Works)
+		}
+		if err == nil {
+			err = attachTags(db, page.Works)
+		}
+		if err != nil {
+			http.Error(w, "Error querying database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// take a work back out of the trash as it was when it was deleted
+func restoreWork(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		res, err := db.Exec(`UPDATE works SET deleted_at = NULL, updated_at = NOW() WHERE id = $1 AND deleted_at IS NOT NULL`, id)
+		if err != nil {
+			http.Error(w, "Failed to restore work: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Work not found in the trash", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	}
+}
+
+// purge works that have been in the trash longer than the retention every trashPurgeInterval
+func runTrashPurger(db *sql.DB, store Storage) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			n, err := purgeTrashedWorks(context.Background(), db, store)
+			if err != nil {
+				log.Printf("Failed to purge trashed works: %s", err.Error())
+			}
+			if err != nil || n < trashPurgeBatch {
+				break
+			}
+		}
+	}
+}
+
+// delete one batch of works whose retention has passed along with their texts, images and
+// revisions, then remove the files nothing refers to anymore. SKIP LOCKED keeps replicas
+// from purging the same works
+func purgeTrashedWorks(ctx context.Context, db *sql.DB, store Storage) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int64
+	err = tx.QueryRow(`
+		SELECT ARRAY(
+			SELECT id FROM works
+			WHERE deleted_at < NOW() - make_interval(days => $1)
+			ORDER BY deleted_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)`, trashRetentionDays, trashPurgeBatch).Scan(pq.Array(&ids))
+	if err != nil || len(ids) == 0 {
+		tx.Rollback()
+		return 0, err
+	}
+
+	files, err := imageFiles(tx, "i.work_id = ANY($1)", pq.Array(ids))
+	if err == nil {
+		var revisionFiles []string
+		err = tx.QueryRow(`SELECT ARRAY(SELECT DISTINCT unnest(files) FROM work_revisions WHERE work_id = ANY($1))`,
+			pq.Array(ids)).Scan(pq.Array(&revisionFiles))
+		files = append(files, revisionFiles...)
+	}
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM works WHERE id = ANY($1)`, pq.Array(ids))
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	deleteUnreferencedFiles(ctx, db, store, files)
+	log.Printf("purged %d trashed works", len(ids))
+	return len(ids), nil
+}
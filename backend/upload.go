@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"slices"
+
+	"github.com/lib/pq"
+)
+
+const defaultMaxUploadMB = 10
+
+// how many files one request may upload to a work
+var maxUploadFiles = envInt("UPLOAD_MAX_FILES", 10)
+
+// sniffed content types accepted for uploads and the extension files are stored with.
+// anything else, svg and html included, is rejected no matter what the filename says
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+}
+
+// the upload rules of a category, from its row in categories
+type uploadRules struct {
+	category   string
+	imageTypes []string // nil accepts every format
+	maxBytes   int64
+	pixelated  bool
+}
+
+// load the upload rules of a category, sql.ErrNoRows when it doesn't exist
+func categoryUploadRules(q queryer, slug string) (*uploadRules, error) {
+	rules := &uploadRules{category: slug}
+	var maxMB sql.NullInt64
+	err := q.QueryRow(`SELECT image_types, max_upload_mb, pixelated FROM categories WHERE slug = $1`, slug).Scan(
+		pq.Array(&rules.imageTypes), &maxMB, &rules.pixelated)
+	if err != nil {
+		return nil, err
+	}
+	rules.maxBytes = uploadLimitMB(maxMB) << 20
+	return rules, nil
+}
+
+// a category's limit in megabytes, UPLOAD_MAX_MB for categories without one
+func uploadLimitMB(maxMB sql.NullInt64) int64 {
+	if maxMB.Valid {
+		return maxMB.Int64
+	}
+	return int64(envInt("UPLOAD_MAX_MB", defaultMaxUploadMB))
+}
+
+// upload rejection reported as json so the admin ui can tell the user what is allowed
+type uploadError struct {
+	status   int
+	Code     string   `json:"code"`
+	Message  string   `json:"error"`
+	Allowed  []string `json:"allowed,omitempty"`
+	MaxBytes int64    `json:"max_bytes,omitempty"`
+}
+
+func writeUploadError(w http.ResponseWriter, e *uploadError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// cap the request body at maxUploadFiles of the largest category limit plus room for the other form fields
+func limitUploadBody(db *sql.DB, w http.ResponseWriter, r *http.Request) error {
+	var maxMB sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(max_upload_mb) FROM categories`).Scan(&maxMB); err != nil {
+		return err
+	}
+	limit := max(uploadLimitMB(maxMB), uploadLimitMB(sql.NullInt64{})) << 20
+	r.Body = http.MaxBytesReader(w, r.Body, limit*int64(maxUploadFiles)+1<<20)
+	return nil
+}
+
+// parse a multipart form whose body was limited by limitUploadBody, reporting oversized bodies as 413
+func parseUploadForm(db *sql.DB, w http.ResponseWriter, r *http.Request) bool {
+	if err := limitUploadBody(db, w, r); err != nil {
+		http.Error(w, "Failed to fetch upload limits: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeUploadError(w, &uploadError{
+				status:   http.StatusRequestEntityTooLarge,
+				Code:     "request_too_large",
+				Message:  "Request body is too large",
+				MaxBytes: tooLarge.Limit,
+			})
+			return false
+		}
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// check an uploaded file's size and sniffed type against the category's rules, returning the detected content type
+func validateUpload(file multipart.File, header *multipart.FileHeader, rules *uploadRules) (string, *uploadError) {
+	allowed := rules.imageTypes
+	if allowed == nil {
+		allowed = slices.Sorted(maps.Keys(imageExtensions))
+	}
+
+	if header.Size > rules.maxBytes {
+		return "", &uploadError{
+			status:   http.StatusRequestEntityTooLarge,
+			Code:     "file_too_large",
+			Message:  fmt.Sprintf("File is larger than the %d MB allowed for %s", rules.maxBytes>>20, rules.category),
+			MaxBytes: rules.maxBytes,
+		}
+	}
+
+	// the magic bytes decide the type, the client's filename and Content-Type are ignored
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", &uploadError{status: http.StatusBadRequest, Code: "unreadable_file", Message: "Failed to read uploaded file"}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", &uploadError{status: http.StatusBadRequest, Code: "unreadable_file", Message: "Failed to read uploaded file"}
+	}
+
+	detected := http.DetectContentType(head[:n])
+	for _, t := range allowed {
+		if t == detected {
+			return detected, nil
+		}
+	}
+	return "", &uploadError{
+		status:  http.StatusUnsupportedMediaType,
+		Code:    "unsupported_media_type",
+		Message: fmt.Sprintf("Files of type %s are not allowed for %s", detected, rules.category),
+		Allowed: allowed,
+	}
+}
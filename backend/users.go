@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 10
+
+var errUserExists = errors.New("a user with that username or email already exists")
+
+// minimum strength policy: long enough, mixes letters with digits or symbols, doesn't contain the username
+func validatePassword(username, password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	// bcrypt ignores everything after 72 bytes
+	if len(password) > 72 {
+		return errors.New("password must be at most 72 bytes long")
+	}
+
+	var letter, other bool
+	for _, c := range password {
+		if unicode.IsLetter(c) {
+			letter = true
+		} else {
+			other = true
+		}
+	}
+	if !letter || !other {
+		return errors.New("password must contain letters and at least one digit or symbol")
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// insert a user with a bcrypt hashed password and return its id
+func createUser(db *sql.DB, username, email, password, role string) (int, error) {
+	if username == "" || email == "" {
+		return 0, errors.New("username and email are required")
+	}
+	if !validRole(role) {
+		return 0, fmt.Errorf("role must be one of %v", roles)
+	}
+	if err := validatePassword(username, password); err != nil {
+		return 0, err
+	}
+
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = $1 OR email = $2)`, username, email).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, errUserExists
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = db.QueryRow(`INSERT INTO users (username, email, password, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, NOW(), NOW()) RETURNING id`, username, email, hash, role).Scan(&id)
+	return id, err
+}
+
+// replace a user's password hash, bump the token version and end all refresh sessions, returning the new version
+func setPassword(db *sql.DB, username, password string) (int, error) {
+	if err := validatePassword(username, password); err != nil {
+		return 0, err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID, tokenVersion int
+	err = tx.QueryRow(`UPDATE users SET password = $1, token_version = token_version + 1, updated_at = NOW()
+		WHERE username = $2 RETURNING id, token_version`, hash, username).Scan(&userID, &tokenVersion)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("user %q not found", username)
+	} else if err != nil {
+		return 0, err
+	}
+
+	// refresh tokens would otherwise keep minting access tokens for the old sessions
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`, userID); err != nil {
+		return 0, err
+	}
+
+	return tokenVersion, tx.Commit()
+}
+
+func deleteUser(db *sql.DB, username string) error {
+	res, err := db.Exec(`DELETE FROM users WHERE username = $1`, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %q not found", username)
+	}
+	return nil
+}
+
+func listUsers(db *sql.DB, out io.Writer) error {
+	rows, err := db.Query(`SELECT id, username, email, role, created_at FROM users ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Id, &u.Username, &u.Email, &u.Role, &u.CreatedAt); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\n", u.Id, u.Username, u.Email, u.Role, u.CreatedAt)
+	}
+	return rows.Err()
+}
+
+// create the first admin from ADMIN_USERNAME, ADMIN_EMAIL and ADMIN_PASSWORD when the users table is empty
+func bootstrapAdmin(db *sql.DB) error {
+	username := os.Getenv("ADMIN_USERNAME")
+	email := os.Getenv("ADMIN_EMAIL")
+	password := os.Getenv("ADMIN_PASSWORD")
+	if username == "" || email == "" || password == "" {
+		return nil
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if _, err := createUser(db, username, email, password, "admin"); err != nil {
+		return err
+	}
+	log.Printf("created admin user %q from environment", username)
+	return nil
+}
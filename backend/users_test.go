@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"letters and digits", "alice", "correct7horse", false},
+		{"letters and symbols", "alice", "correct-horse", false},
+		{"exactly the minimum length", "alice", "abcdefghi1", false},
+		{"exactly 72 bytes", "alice", strings.Repeat("a", 71) + "1", false},
+		{"non-ascii letters", "alice", "grüße-aus-köln", false},
+		{"no username given", "", "correct7horse", false},
+		{"too short", "alice", "abcdefgh1", true},
+		{"over 72 bytes", "alice", strings.Repeat("a", 72) + "1", true},
+		{"only letters", "alice", "correcthorse", true},
+		{"only digits", "alice", "1234567890", true},
+		{"contains the username", "alice", "my-alice-pass", true},
+		{"contains the username in another case", "Alice", "my-ALICE-pass", true},
+	}
+	for _, tt := range tests {
+		err := validatePassword(tt.username, tt.password)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validatePassword = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// refuse to decode images above this many pixels, a small file can claim huge dimensions
+const maxImagePixels = 100_000_000
+
+// widths of the resized copies generated for every uploaded image, sizes at or above
+// the original width are skipped rather than upscaled except for pixel art, which is
+// enlarged by whole factors
+var imageSizes = []struct {
+	name  string
+	width int
+}{
+	{"thumbnail", 320},
+	{"medium", 800},
+	{"large", 1600},
+}
+
+// a resized copy of an image, served in srcset alongside the original
+type ImageVariant struct {
+	Size        string `json:"size"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	URL         string `json:"url"`
+	Bytes       int64  `json:"bytes,omitempty"` // file size, lets clients pick the lighter format
+	path        string
+	data        []byte // the encoded file until putFile stores it
+}
+
+// uploads that pass the type check but can't be decoded
+var errInvalidImage = errors.New("invalid image")
+
+// resize the uploaded original and encode each size in its own format, with a WebP copy next to
+// it when that is smaller. pixelated categories are scaled nearest-neighbour so edges stay crisp,
+// and small pixel art gets enlarged copies. the variants carry their encoded data for the caller
+// to store
+func generateVariants(data []byte, contentType string, pixelated bool, orientation int) ([]ImageVariant, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d is larger than the %d pixels allowed", errInvalidImage, cfg.Width, cfg.Height, maxImagePixels)
+	}
+
+	// animated gifs keep only their original, a single-frame variant would lose the animation
+	if contentType == "image/gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+		}
+		if len(g.Image) > 1 {
+			return nil, nil
+		}
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	src = applyOrientation(src, orientation)
+
+	var scaler draw.Scaler = draw.CatmullRom
+	if pixelated {
+		scaler = draw.NearestNeighbor
+	}
+
+	// jpeg stays jpeg, gif and png become png, webp originals only get webp variants. photos
+	// are encoded as lossy webp and graphics as lossless webp, the copy is kept when it is smaller
+	fallback := "image/png"
+	if contentType == "image/jpeg" || contentType == "image/webp" {
+		fallback = contentType
+	}
+	withWebP := fallback != "image/webp"
+	photo := contentType == "image/jpeg" || contentType == "image/webp" && webpIsLossy(data)
+
+	bounds := src.Bounds()
+	var variants []ImageVariant
+	for _, size := range imageSizes {
+		width, height := size.width, max(1, bounds.Dy()*size.width/bounds.Dx())
+		if size.width >= bounds.Dx() {
+			if !pixelated {
+				break
+			}
+			// blowing pixel art up by a whole factor keeps every pixel a square block, the
+			// longer side decides the factor so the copy fits within the size
+			factor := size.width / max(bounds.Dx(), bounds.Dy())
+			if factor < 2 {
+				continue
+			}
+			width, height = bounds.Dx()*factor, bounds.Dy()*factor
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		scaler.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+		variant := func(format string) (ImageVariant, error) {
+			var buf bytes.Buffer
+			err := encodeImage(&buf, dst, format, photo)
+			return ImageVariant{
+				Size:        size.name,
+				ContentType: format,
+				Width:       width,
+				Height:      height,
+				Bytes:       int64(buf.Len()),
+				data:        buf.Bytes(),
+			}, err
+		}
+
+		v, err := variant(fallback)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+		if withWebP {
+			webp, err := variant("image/webp")
+			if err != nil {
+				return nil, err
+			}
+			if webp.Bytes < v.Bytes {
+				variants = append(variants, webp)
+			}
+		}
+	}
+	return variants, nil
+}
+
+// encode a variant, photo picks lossy webp over lossless
+func encodeImage(w io.Writer, img image.Image, contentType string, photo bool) error {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "image/png":
+		return png.Encode(w, img)
+	case "image/webp":
+		// lossless webp suits pixel art and graphics but is several times heavier than jpeg for photos
+		if photo {
+			return encodeLossyWebP(w, img, 85)
+		}
+		return nativewebp.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("cannot encode %s", contentType)
+	}
+}
+
+// whether a webp file holds a lossy VP8 image without an alpha channel, which the lossy
+// encoder can stand in for
+func webpIsLossy(data []byte) bool {
+	lossy := false
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		switch string(data[pos : pos+4]) {
+		case "VP8 ":
+			lossy = true
+		case "VP8L", "ALPH":
+			return false
+		}
+		pos += 8 + size + size&1
+	}
+	return lossy
+}
+
+func saveVariants(tx *sql.Tx, imageID int, variants []ImageVariant) error {
+	for _, v := range variants {
+		_, err := tx.Exec(`
+			INSERT INTO image_variants (image_id, size, content_type, path, width, height)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			imageID, v.Size, v.ContentType, v.path, v.Width, v.Height)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove stored files whose rows are gone, failures only leave orphans behind so they are logged
+func deleteFiles(ctx context.Context, store Storage, keys []string) {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete stored file %s: %s", key, err.Error())
+		}
+	}
+}
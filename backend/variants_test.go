@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodeTestImage(t *testing.T, img image.Image, contentType string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGenerateVariantsPhoto(t *testing.T) {
+	data := encodeTestImage(t, testPhoto(1000, 600), "image/jpeg")
+
+	variants, err := generateVariants(data, "image/jpeg", false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formats := map[string][]string{}
+	for _, v := range variants {
+		formats[v.Size] = append(formats[v.Size], v.ContentType)
+		if v.ContentType == "image/webp" && !webpIsLossy(v.data) {
+			t.Errorf("%s webp of a photo is lossless", v.Size)
+		}
+		m, _, err := image.Decode(bytes.NewReader(v.data))
+		if err != nil {
+			t.Fatalf("%s %s does not decode: %v", v.Size, v.ContentType, err)
+		}
+		if m.Bounds().Dx() != v.Width || m.Bounds().Dy() != v.Height {
+			t.Errorf("%s %s is %v, want %dx%d", v.Size, v.ContentType, m.Bounds(), v.Width, v.Height)
+		}
+	}
+	// the large size is wider than the original
+	want := map[string][]string{
+		"thumbnail": {"image/jpeg", "image/webp"},
+		"medium":    {"image/jpeg", "image/webp"},
+	}
+	for size, types := range want {
+		if got := formats[size]; len(got) != len(types) || got[0] != types[0] || got[1] != types[1] {
+			t.Errorf("%s variants are %v, want %v", size, got, types)
+		}
+	}
+	if len(formats) != len(want) {
+		t.Errorf("got sizes %v, want %v", formats, want)
+	}
+}
+
+func TestGenerateVariantsPixelArt(t *testing.T) {
+	sprite := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			sprite.SetRGBA(x, y, color.RGBA{uint8(x * 6), uint8(y * 8), uint8((x + y) % 2 * 255), 255})
+		}
+	}
+	data := encodeTestImage(t, sprite, "image/png")
+
+	// without pixelated scaling an image smaller than every size has no variants
+	variants, err := generateVariants(data, "image/png", false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 0 {
+		t.Errorf("got %d variants of a small image, want none", len(variants))
+	}
+
+	variants, err = generateVariants(data, "image/png", true, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factors := map[string]int{"thumbnail": 8, "medium": 20, "large": 40}
+	seen := map[string]bool{}
+	for _, v := range variants {
+		factor := factors[v.Size]
+		if v.Width != 40*factor || v.Height != 30*factor {
+			t.Errorf("%s %s is %dx%d, want %dx%d", v.Size, v.ContentType, v.Width, v.Height, 40*factor, 30*factor)
+			continue
+		}
+		seen[v.Size] = true
+		m, _, err := image.Decode(bytes.NewReader(v.data))
+		if err != nil {
+			t.Fatalf("%s %s does not decode: %v", v.Size, v.ContentType, err)
+		}
+		// every source pixel becomes a solid factor x factor block, checked at every third pixel
+		for y := 0; y < v.Height; y += 3 {
+			for x := 0; x < v.Width; x += 3 {
+				r1, g1, b1, _ := m.At(x, y).RGBA()
+				r2, g2, b2, _ := sprite.At(x/factor, y/factor).RGBA()
+				if r1 != r2 || g1 != g2 || b1 != b2 {
+					t.Fatalf("%s %s pixel %d,%d does not match source pixel %d,%d", v.Size, v.ContentType, x, y, x/factor, y/factor)
+				}
+			}
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("got sizes %v, want thumbnail, medium and large", seen)
+	}
+}
+
+func TestWebPIsLossy(t *testing.T) {
+	chunk := func(fourCC string, size int) []byte {
+		b := append([]byte(fourCC), byte(size), 0, 0, 0)
+		return append(b, make([]byte, size+size&1)...)
+	}
+	file := func(chunks ...[]byte) []byte {
+		b := []byte("RIFF\x00\x00\x00\x00WEBP")
+		for _, c := range chunks {
+			b = append(b, c...)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"lossy", file(chunk("VP8 ", 10)), true},
+		{"lossless", file(chunk("VP8L", 10)), false},
+		{"extended lossy", file(chunk("VP8X", 10), chunk("VP8 ", 11)), true},
+		{"lossy with alpha", file(chunk("VP8X", 10), chunk("ALPH", 5), chunk("VP8 ", 10)), false},
+		{"truncated", file()[:10], false},
+	}
+	for _, tt := range tests {
+		if got := webpIsLossy(tt.data); got != tt.want {
+			t.Errorf("%s: webpIsLossy = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,836 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// lossy WebP for photo variants. nativewebp only writes lossless WebP, several times heavier than
+// JPEG for photos, so this writes a single VP8 key frame (RFC 6386) with 16x16 luma and 8x8 chroma
+// intra prediction, one token partition and token probabilities tuned to the image. there is no
+// alpha channel, it is only used for opaque sources
+
+const vp8MaxDimension = 16383
+
+// VP8 intra prediction modes of whole macroblocks, in the order they are tried
+const (
+	vp8PredDC = iota
+	vp8PredTM
+	vp8PredV
+	vp8PredH
+)
+
+// block types, selecting the token probabilities
+const (
+	vp8PlaneYAfterY2 = iota
+	vp8PlaneY2
+	vp8PlaneUV
+)
+
+var (
+	vp8Bands  = [17]int{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7, 0}
+	vp8Zigzag = [16]int{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+	// extra bit probabilities of the DCT_CAT3 to DCT_CAT6 tokens
+	vp8CatProbs = [4][]uint8{
+		{173, 148, 140},
+		{176, 155, 140, 135},
+		{180, 157, 141, 134, 130},
+		{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+	}
+	vp8DCQuant = [128]int32{
+		4, 5, 6, 7, 8, 9, 10, 10, 11, 12, 13, 14, 15, 16, 17, 17,
+		18, 19, 20, 20, 21, 21, 22, 22, 23, 23, 24, 25, 25, 26, 27, 28,
+		29, 30, 31, 32, 33, 34, 35, 36, 37, 37, 38, 39, 40, 41, 42, 43,
+		44, 45, 46, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58,
+		59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 69, 70, 71, 72, 73, 74,
+		75, 76, 76, 77, 78, 79, 80, 81, 82, 83, 84, 85, 86, 87, 88, 89,
+		91, 93, 95, 96, 98, 100, 101, 102, 104, 106, 108, 110, 112, 114, 116, 118,
+		122, 124, 126, 128, 130, 132, 134, 136, 138, 140, 143, 145, 148, 151, 154, 157,
+	}
+	vp8ACQuant = [128]int32{
+		4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+		20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35,
+		36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
+		52, 53, 54, 55, 56, 57, 58, 60, 62, 64, 66, 68, 70, 72, 74, 76,
+		78, 80, 82, 84, 86, 88, 90, 92, 94, 96, 98, 100, 102, 104, 106, 108,
+		110, 112, 114, 116, 119, 122, 125, 128, 131, 134, 137, 140, 143, 146, 149, 152,
+		155, 158, 161, 164, 167, 170, 173, 177, 181, 185, 189, 193, 197, 201, 205, 209,
+		213, 217, 221, 225, 229, 234, 239, 245, 249, 254, 259, 264, 269, 274, 279, 284,
+	}
+)
+
+// the quantized coefficients of a macroblock in zigzag order, kept between the pass that
+// counts token statistics and the pass that writes them
+type vp8Macroblock struct {
+	yMode, uvMode int
+	skip          bool // no coefficient is coded
+	y2            [16]int16
+	y             [16][16]int16
+	uv            [8][16]int16 // four U blocks then four V blocks
+}
+
+// DC and AC quantizer steps of each block type
+type vp8Quant struct {
+	y1, y2, uv [2]int32
+}
+
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+	// source planes padded to whole macroblocks, and the reconstruction a decoder will see
+	// which the predictions are made from
+	y, u, v     []uint8
+	ry, ru, rv  []uint8
+	qi          int
+	quant       vp8Quant
+	filterLevel int
+	mbs         []vp8Macroblock
+
+	probs    [4][8][3][11]uint8
+	counting bool
+	stats    [4][8][3][11][2]uint32
+	tokens   *boolEncoder
+}
+
+// encode img as a lossy WebP, quality runs from 0 to 100 like JPEG's
+func encodeLossyWebP(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > vp8MaxDimension || b.Dy() > vp8MaxDimension {
+		return errors.New("webp: image dimensions out of range")
+	}
+
+	e := newVP8Encoder(b.Dx(), b.Dy(), quality)
+	e.importImage(img)
+	data, err := e.encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func newVP8Encoder(width, height, quality int) *vp8Encoder {
+	qi := (100 - min(max(quality, 0), 100)) * 127 / 100
+	return &vp8Encoder{
+		width:  width,
+		height: height,
+		mbw:    (width + 15) / 16,
+		mbh:    (height + 15) / 16,
+		qi:     qi,
+		quant: vp8Quant{
+			y1: [2]int32{vp8DCQuant[qi], vp8ACQuant[qi]},
+			y2: [2]int32{vp8DCQuant[qi] * 2, max(vp8ACQuant[qi]*155/100, 8)},
+			uv: [2]int32{vp8DCQuant[min(qi, 117)], vp8ACQuant[qi]},
+		},
+		// the loop filter smooths block edges more as the quantizer coarsens
+		filterLevel: min(int(vp8ACQuant[qi])/4, 63),
+		probs:       vp8DefaultTokenProbs,
+	}
+}
+
+// the RIFF file of the imported image
+func (e *vp8Encoder) encode() ([]byte, error) {
+	e.mbs = make([]vp8Macroblock, e.mbw*e.mbh)
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+
+	// count the tokens first so the header can carry probabilities that fit them
+	e.counting = true
+	e.writeTokens()
+	e.counting = false
+	header := e.writeHeader()
+	if len(header) >= 1<<19 {
+		return nil, errors.New("webp: first partition too large")
+	}
+	e.tokens = &boolEncoder{}
+	e.writeTokens()
+	partition := e.tokens.flush()
+
+	frame := make([]byte, 10, 10+len(header)+len(partition))
+	tag := uint32(len(header))<<5 | 1<<4 // key frame, version 0, shown
+	frame[0], frame[1], frame[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+	frame[3], frame[4], frame[5] = 0x9d, 0x01, 0x2a
+	binary.LittleEndian.PutUint16(frame[6:], uint16(e.width))
+	binary.LittleEndian.PutUint16(frame[8:], uint16(e.height))
+	frame = append(append(frame, header...), partition...)
+
+	pad := len(frame) & 1
+	riff := make([]byte, 20, 20+len(frame)+pad)
+	copy(riff, "RIFF")
+	binary.LittleEndian.PutUint32(riff[4:], uint32(12+len(frame)+pad))
+	copy(riff[8:], "WEBPVP8 ")
+	binary.LittleEndian.PutUint32(riff[16:], uint32(len(frame)))
+	riff = append(riff, frame...)
+	if pad == 1 {
+		riff = append(riff, 0)
+	}
+	return riff, nil
+}
+
+// convert to the limited range BT.601 YCbCr VP8 is decoded as, averaging chroma over 2x2 pixels
+// and repeating the edge pixels into the padding
+func (e *vp8Encoder) importImage(img image.Image) {
+	b := img.Bounds()
+	yStride, cStride := 16*e.mbw, 8*e.mbw
+	e.y = make([]uint8, yStride*16*e.mbh)
+	e.u = make([]uint8, cStride*8*e.mbh)
+	e.v = make([]uint8, cStride*8*e.mbh)
+	e.ry = make([]uint8, len(e.y))
+	e.ru = make([]uint8, len(e.u))
+	e.rv = make([]uint8, len(e.v))
+
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(b)
+		draw.Draw(rgba, b, img, b.Min, draw.Src)
+	}
+	rgb := func(x, y int) (int32, int32, int32) {
+		i := rgba.PixOffset(b.Min.X+min(x, b.Dx()-1), b.Min.Y+min(y, b.Dy()-1))
+		return int32(rgba.Pix[i]), int32(rgba.Pix[i+1]), int32(rgba.Pix[i+2])
+	}
+	for y := 0; y < 16*e.mbh; y++ {
+		for x := 0; x < yStride; x++ {
+			r, g, bl := rgb(x, y)
+			e.y[y*yStride+x] = uint8((16839*r + 33059*g + 6420*bl + 16<<16 + 1<<15) >> 16)
+		}
+	}
+	for y := 0; y < 8*e.mbh; y++ {
+		for x := 0; x < cStride; x++ {
+			var r, g, bl int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := rgb(2*x+d[0], 2*y+d[1])
+				r, g, bl = r+pr, g+pg, bl+pb
+			}
+			// the sums are four times the average, the shifts take that back out
+			e.u[y*cStride+x] = uint8((-9719*r - 19081*g + 28800*bl + 128<<18 + 1<<17) >> 18)
+			e.v[y*cStride+x] = uint8((28800*r - 24116*g - 4684*bl + 128<<18 + 1<<17) >> 18)
+		}
+	}
+}
+
+// pick the prediction modes, transform and quantize the residual, and reconstruct the
+// macroblock the way a decoder will so later predictions match
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	mb := &e.mbs[mby*e.mbw+mbx]
+	yStride, cStride := 16*e.mbw, 8*e.mbw
+	x0, y0 := 16*mbx, 16*mby
+
+	var pred [256]uint8
+	mb.yMode = e.bestMode(pred[:], 16, mbx, mby, plane{e.y, e.ry, yStride})
+	var coeffs [16][16]int32
+	var dc [16]int32
+	for n := range 16 {
+		bx, by := x0+n%4*4, y0+n/4*4
+		var res [16]int32
+		for j := range 4 {
+			for i := range 4 {
+				res[j*4+i] = int32(e.y[(by+j)*yStride+bx+i]) - int32(pred[(n/4*4+j)*16+n%4*4+i])
+			}
+		}
+		vp8ForwardDCT(&res, &coeffs[n])
+		dc[n] = coeffs[n][0]
+	}
+
+	// the DC of every luma block goes through the Y2 block
+	var y2 [16]int32
+	vp8ForwardWHT(&dc, &y2)
+	var y2Deq [16]int16
+	nonzero := vp8Quantize(&y2, e.quant.y2, 0, &mb.y2, &y2Deq)
+	dcs := vp8InverseWHT(&y2Deq)
+	for n := range 16 {
+		var deq [16]int16
+		if vp8Quantize(&coeffs[n], e.quant.y1, 1, &mb.y[n], &deq) {
+			nonzero = true
+		}
+		deq[0] = dcs[n]
+		off := (y0+n/4*4)*yStride + x0 + n%4*4
+		for j := range 4 {
+			copy(e.ry[off+j*yStride:off+j*yStride+4], pred[(n/4*4+j)*16+n%4*4:][:4])
+		}
+		vp8InverseDCT(&deq, e.ry[off:], yStride)
+	}
+
+	var cpred [2][64]uint8
+	mb.uvMode = e.bestMode(cpred[0][:], 8, mbx, mby, plane{e.u, e.ru, cStride}, plane{e.v, e.rv, cStride})
+	for p, pl := range []plane{{e.u, e.ru, cStride}, {e.v, e.rv, cStride}} {
+		if p == 1 {
+			predict(cpred[1][:], pl.rec, cStride, 8*mbx, 8*mby, 8, mb.uvMode, mbx, mby)
+		}
+		for n := range 4 {
+			bx, by := 8*mbx+n%2*4, 8*mby+n/2*4
+			var res, c [16]int32
+			for j := range 4 {
+				for i := range 4 {
+					res[j*4+i] = int32(pl.src[(by+j)*cStride+bx+i]) - int32(cpred[p][(n/2*4+j)*8+n%2*4+i])
+				}
+			}
+			vp8ForwardDCT(&res, &c)
+			var deq [16]int16
+			if vp8Quantize(&c, e.quant.uv, 0, &mb.uv[4*p+n], &deq) {
+				nonzero = true
+			}
+			off := by*cStride + bx
+			for j := range 4 {
+				copy(pl.rec[off+j*cStride:off+j*cStride+4], cpred[p][(n/2*4+j)*8+n%2*4:][:4])
+			}
+			vp8InverseDCT(&deq, pl.rec[off:], cStride)
+		}
+	}
+	mb.skip = !nonzero
+}
+
+// a source plane with the reconstruction predictions are made from
+type plane struct {
+	src, rec []uint8
+	stride   int
+}
+
+// fill pred with the mode whose prediction is closest to the source over all planes, which
+// share the mode
+func (e *vp8Encoder) bestMode(pred []uint8, size, mbx, mby int, planes ...plane) int {
+	best, bestCost := 0, int64(math.MaxInt64)
+	candidate := make([]uint8, size*size)
+	for mode := vp8PredDC; mode <= vp8PredH; mode++ {
+		var cost int64
+		for _, pl := range planes {
+			predict(candidate, pl.rec, pl.stride, size*mbx, size*mby, size, mode, mbx, mby)
+			for j := range size {
+				for i := range size {
+					d := int64(pl.src[(size*mby+j)*pl.stride+size*mbx+i]) - int64(candidate[j*size+i])
+					cost += d * d
+				}
+			}
+		}
+		if cost < bestCost {
+			best, bestCost = mode, cost
+		}
+	}
+	predict(pred, planes[0].rec, planes[0].stride, size*mbx, size*mby, size, best, mbx, mby)
+	return best
+}
+
+// intra prediction of a size x size macroblock from the reconstructed row above and column
+// left of it. outside the image the row above reads 127 and the column left 129
+func predict(dst, rec []uint8, stride, x0, y0, size, mode, mbx, mby int) {
+	top := func(i int) int32 {
+		if mby == 0 {
+			return 127
+		}
+		return int32(rec[(y0-1)*stride+x0+i])
+	}
+	left := func(j int) int32 {
+		if mbx == 0 {
+			return 129
+		}
+		return int32(rec[(y0+j)*stride+x0-1])
+	}
+	corner := int32(127)
+	if mby > 0 {
+		corner = 129
+		if mbx > 0 {
+			corner = int32(rec[(y0-1)*stride+x0-1])
+		}
+	}
+
+	// DC only averages the edges that are inside the image
+	dc := int32(128)
+	shift := 3
+	if size == 16 {
+		shift = 4
+	}
+	var sum int32
+	switch {
+	case mbx > 0 && mby > 0:
+		for k := range size {
+			sum += top(k) + left(k)
+		}
+		dc = (sum + int32(size)) >> (shift + 1)
+	case mby > 0:
+		for k := range size {
+			sum += top(k)
+		}
+		dc = (sum + int32(size/2)) >> shift
+	case mbx > 0:
+		for k := range size {
+			sum += left(k)
+		}
+		dc = (sum + int32(size/2)) >> shift
+	}
+
+	for j := range size {
+		for i := range size {
+			p := dc
+			switch mode {
+			case vp8PredTM:
+				p = min(max(left(j)+top(i)-corner, 0), 255)
+			case vp8PredV:
+				p = top(i)
+			case vp8PredH:
+				p = left(j)
+			}
+			dst[j*size+i] = uint8(p)
+		}
+	}
+}
+
+// the forward 4x4 DCT of libvpx, the counterpart of the decoder's inverse transform
+func vp8ForwardDCT(in, out *[16]int32) {
+	var tmp [16]int32
+	for i := range 4 {
+		r := in[i*4:]
+		a := (r[0] + r[3]) * 8
+		b := (r[1] + r[2]) * 8
+		c := (r[1] - r[2]) * 8
+		d := (r[0] - r[3]) * 8
+		tmp[i*4+0] = a + b
+		tmp[i*4+2] = a - b
+		tmp[i*4+1] = (c*2217 + d*5352 + 14500) >> 12
+		tmp[i*4+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := range 4 {
+		a := tmp[i] + tmp[12+i]
+		b := tmp[4+i] + tmp[8+i]
+		c := tmp[4+i] - tmp[8+i]
+		d := tmp[i] - tmp[12+i]
+		out[i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217 + d*5352 + 12000) >> 16
+		if d != 0 {
+			out[4+i]++
+		}
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+}
+
+// the decoder's inverse DCT, adding the residual to the prediction already in dst
+func vp8InverseDCT(coeff *[16]int16, dst []uint8, stride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := range 4 {
+		a := int32(coeff[i]) + int32(coeff[i+8])
+		b := int32(coeff[i]) - int32(coeff[i+8])
+		c := (int32(coeff[i+4])*c2)>>16 - (int32(coeff[i+12])*c1)>>16
+		d := (int32(coeff[i+4])*c1)>>16 + (int32(coeff[i+12])*c2)>>16
+		m[i] = [4]int32{a + d, b + c, b - c, a - d}
+	}
+	for j := range 4 {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := dst[j*stride:]
+		for i, r := range [4]int32{a + d, b + c, b - c, a - d} {
+			row[i] = uint8(min(max(int32(row[i])+r>>3, 0), 255))
+		}
+	}
+}
+
+// the Walsh-Hadamard transform of the luma DCs. the butterfly is its own inverse up to a
+// scale, the decoder divides by 8 and this by 2 so the pair comes out even
+func vp8ForwardWHT(in, out *[16]int32) {
+	var m [16]int32
+	for i := range 4 {
+		a0 := in[i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[i] - in[12+i]
+		m[i], m[8+i], m[4+i], m[12+i] = a0+a1, a0-a1, a3+a2, a3-a2
+	}
+	for i := range 4 {
+		r := m[i*4:]
+		a0 := r[0] + r[3]
+		a1 := r[1] + r[2]
+		a2 := r[1] - r[2]
+		a3 := r[0] - r[3]
+		for k, v := range [4]int32{a0 + a1, a3 + a2, a0 - a1, a3 - a2} {
+			if v < 0 {
+				out[i*4+k] = -((-v + 1) >> 1)
+			} else {
+				out[i*4+k] = (v + 1) >> 1
+			}
+		}
+	}
+}
+
+// the decoder's inverse WHT, giving the DC of each luma block
+func vp8InverseWHT(coeff *[16]int16) [16]int16 {
+	var m, out [16]int32
+	for i := range 4 {
+		a0 := int32(coeff[i]) + int32(coeff[12+i])
+		a1 := int32(coeff[4+i]) + int32(coeff[8+i])
+		a2 := int32(coeff[4+i]) - int32(coeff[8+i])
+		a3 := int32(coeff[i]) - int32(coeff[12+i])
+		m[i], m[8+i], m[4+i], m[12+i] = a0+a1, a0-a1, a3+a2, a3-a2
+	}
+	for i := range 4 {
+		dc := m[i*4] + 3
+		a0 := dc + m[i*4+3]
+		a1 := m[i*4+1] + m[i*4+2]
+		a2 := m[i*4+1] - m[i*4+2]
+		a3 := dc - m[i*4+3]
+		out[i*4], out[i*4+1], out[i*4+2], out[i*4+3] = (a0+a1)>>3, (a3+a2)>>3, (a0-a1)>>3, (a3-a2)>>3
+	}
+	var dcs [16]int16
+	for i, v := range out {
+		dcs[i] = int16(v)
+	}
+	return dcs
+}
+
+// quantize coefficients from position first on into zigzag ordered levels, and dequantize
+// them the way the decoder does. reports whether any level is nonzero
+func vp8Quantize(coeffs *[16]int32, q [2]int32, first int, levels, deq *[16]int16) bool {
+	nonzero := false
+	for i := first; i < 16; i++ {
+		z := vp8Zigzag[i]
+		step, bias := q[1], q[1]/3 // a dead zone on AC drops noise that isn't worth its bits
+		if z == 0 {
+			step, bias = q[0], q[0]/2
+		}
+		c := coeffs[z]
+		level := min((abs32(c)+bias)/step, 2048)
+		if level == 0 {
+			levels[i] = 0
+			continue
+		}
+		nonzero = true
+		d := level * step
+		if c < 0 {
+			level, d = -level, -d
+		}
+		levels[i] = int16(level)
+		deq[z] = int16(d)
+	}
+	return nonzero
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// the token partition, or in the counting pass the statistics of every token probability.
+// the coded-coefficient flags of the blocks above and left give each block its context
+func (e *vp8Encoder) writeTokens() {
+	type nz struct {
+		y  [4]int
+		uv [4]int // U then V
+		y2 int
+	}
+	above := make([]nz, e.mbw)
+	for mby := 0; mby < e.mbh; mby++ {
+		var left nz
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &e.mbs[mby*e.mbw+mbx]
+			up := &above[mbx]
+			if mb.skip {
+				*up, left = nz{}, nz{}
+				continue
+			}
+			f := e.putBlock(vp8PlaneY2, left.y2+up.y2, 0, &mb.y2)
+			left.y2, up.y2 = f, f
+			for j := range 4 {
+				for i := range 4 {
+					f := e.putBlock(vp8PlaneYAfterY2, left.y[j]+up.y[i], 1, &mb.y[j*4+i])
+					left.y[j], up.y[i] = f, f
+				}
+			}
+			for c := 0; c < 4; c += 2 {
+				for j := range 2 {
+					for i := range 2 {
+						f := e.putBlock(vp8PlaneUV, left.uv[c+j]+up.uv[c+i], 0, &mb.uv[2*c+j*2+i])
+						left.uv[c+j], up.uv[c+i] = f, f
+					}
+				}
+			}
+		}
+	}
+}
+
+// code the levels of one block from position first on, reporting 1 when any was coded
+func (e *vp8Encoder) putBlock(plane, ctx, first int, levels *[16]int16) int {
+	last := -1
+	for i := first; i < 16; i++ {
+		if levels[i] != 0 {
+			last = i
+		}
+	}
+	n := first
+	band, c := vp8Bands[n], ctx
+	if last < 0 {
+		e.putToken(false, plane, band, c, 0)
+		return 0
+	}
+	e.putToken(true, plane, band, c, 0)
+	for n < 16 {
+		v := int32(levels[n])
+		n++
+		if v == 0 {
+			e.putToken(false, plane, band, c, 1)
+			band, c = vp8Bands[n], 0
+			continue
+		}
+		e.putToken(true, plane, band, c, 1)
+		a := abs32(v)
+		if a == 1 {
+			e.putToken(false, plane, band, c, 2)
+		} else {
+			e.putToken(true, plane, band, c, 2)
+			switch {
+			case a <= 4:
+				e.putToken(false, plane, band, c, 3)
+				e.putToken(a > 2, plane, band, c, 4)
+				if a > 2 {
+					e.putToken(a == 4, plane, band, c, 5)
+				}
+			case a <= 10:
+				e.putToken(true, plane, band, c, 3)
+				e.putToken(false, plane, band, c, 6)
+				e.putToken(a > 6, plane, band, c, 7)
+				if a <= 6 {
+					e.putFixed(a == 6, 159)
+				} else {
+					e.putFixed((a-7)&2 != 0, 165)
+					e.putFixed((a-7)&1 != 0, 145)
+				}
+			default:
+				e.putToken(true, plane, band, c, 3)
+				e.putToken(true, plane, band, c, 6)
+				cat := 3
+				for i, limit := range []int32{19, 35, 67} {
+					if a < limit {
+						cat = i
+						break
+					}
+				}
+				e.putToken(cat >= 2, plane, band, c, 8)
+				e.putToken(cat&1 == 1, plane, band, c, 9+cat/2)
+				extra := a - (3 + 8<<cat)
+				probs := vp8CatProbs[cat]
+				for i, p := range probs {
+					e.putFixed(extra>>(len(probs)-1-i)&1 == 1, p)
+				}
+			}
+		}
+		e.putFixed(v < 0, 128)
+		if a == 1 {
+			band, c = vp8Bands[n], 1
+		} else {
+			band, c = vp8Bands[n], 2
+		}
+		if n == 16 {
+			break
+		}
+		e.putToken(n <= last, plane, band, c, 0)
+		if n > last {
+			break
+		}
+	}
+	return 1
+}
+
+func (e *vp8Encoder) putToken(bit bool, plane, band, ctx, node int) {
+	if e.counting {
+		e.stats[plane][band][ctx][node][btoi(bit)]++
+		return
+	}
+	e.tokens.put(bit, e.probs[plane][band][ctx][node])
+}
+
+func (e *vp8Encoder) putFixed(bit bool, prob uint8) {
+	if !e.counting {
+		e.tokens.put(bit, prob)
+	}
+}
+
+// the first partition: the frame header, with the token probabilities worth updating, and
+// the prediction modes of every macroblock
+func (e *vp8Encoder) writeHeader() []byte {
+	h := &boolEncoder{}
+	h.putLiteral(0, 2) // color space and clamping type
+	h.putLiteral(0, 1) // no segmentation
+	h.putLiteral(0, 1) // normal loop filter
+	h.putLiteral(uint32(e.filterLevel), 6)
+	h.putLiteral(0, 3) // sharpness
+	h.putLiteral(0, 1) // no loop filter deltas
+	h.putLiteral(0, 2) // one token partition
+	h.putLiteral(uint32(e.qi), 7)
+	h.putLiteral(0, 5) // no quantizer deltas
+	h.putLiteral(0, 1) // refresh_entropy_probs
+
+	for i := range e.probs {
+		for j := range e.probs[i] {
+			for k := range e.probs[i][j] {
+				for l := range e.probs[i][j][k] {
+					upd := vp8TokenUpdateProbs[i][j][k][l]
+					p, ok := updatedProb(e.stats[i][j][k][l], e.probs[i][j][k][l], upd)
+					h.put(ok, upd)
+					if ok {
+						h.putLiteral(uint32(p), 8)
+						e.probs[i][j][k][l] = p
+					}
+				}
+			}
+		}
+	}
+
+	skipped := 0
+	for _, mb := range e.mbs {
+		if mb.skip {
+			skipped++
+		}
+	}
+	skipProb := uint8(min(max((len(e.mbs)-skipped)*256/len(e.mbs), 1), 255))
+	h.putLiteral(1, 1)
+	h.putLiteral(uint32(skipProb), 8)
+
+	for _, mb := range e.mbs {
+		h.put(mb.skip, skipProb)
+		h.put(true, 145) // a 16x16 mode rather than 4x4 ones
+		switch mb.yMode {
+		case vp8PredDC:
+			h.put(false, 156)
+			h.put(false, 163)
+		case vp8PredV:
+			h.put(false, 156)
+			h.put(true, 163)
+		case vp8PredH:
+			h.put(true, 156)
+			h.put(false, 128)
+		case vp8PredTM:
+			h.put(true, 156)
+			h.put(true, 128)
+		}
+		switch mb.uvMode {
+		case vp8PredDC:
+			h.put(false, 142)
+		case vp8PredV:
+			h.put(true, 142)
+			h.put(false, 114)
+		case vp8PredH:
+			h.put(true, 142)
+			h.put(true, 114)
+			h.put(false, 183)
+		case vp8PredTM:
+			h.put(true, 142)
+			h.put(true, 114)
+			h.put(true, 183)
+		}
+	}
+	return h.flush()
+}
+
+// the probability that fits the counted zeros and ones, when it saves more than the update costs
+func updatedProb(counts [2]uint32, old, upd uint8) (uint8, bool) {
+	total := counts[0] + counts[1]
+	if total == 0 {
+		return old, false
+	}
+	p := uint8(min(max((counts[0]*256+total/2)/total, 1), 255))
+	bits := func(p uint8) float64 {
+		return float64(counts[0])*bitCost(false, p) + float64(counts[1])*bitCost(true, p)
+	}
+	keep := bits(old) + bitCost(false, upd)
+	update := bits(p) + bitCost(true, upd) + 8
+	return p, update < keep
+}
+
+// the bits a boolean costs when coded with prob, the probability of a zero out of 256
+func bitCost(bit bool, prob uint8) float64 {
+	if bit {
+		return -math.Log2(float64(256-int(prob)) / 256)
+	}
+	return -math.Log2(float64(prob) / 256)
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// the boolean entropy encoder of RFC 6386 section 7
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func (b *boolEncoder) put(bit bool, prob uint8) {
+	if b.rng == 0 {
+		b.rng, b.bitCount = 255, 24
+	}
+	split := 1 + ((b.rng - 1) * uint32(prob) >> 8)
+	if bit {
+		b.bottom += split
+		b.rng -= split
+	} else {
+		b.rng = split
+	}
+	for b.rng < 128 {
+		b.rng <<= 1
+		if b.bottom&(1<<31) != 0 {
+			b.carry()
+		}
+		b.bottom <<= 1
+		b.bitCount--
+		if b.bitCount == 0 {
+			b.buf = append(b.buf, byte(b.bottom>>24))
+			b.bottom &= 1<<24 - 1
+			b.bitCount = 8
+		}
+	}
+}
+
+// n bits of v with even odds, most significant first
+func (b *boolEncoder) putLiteral(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.put(v>>i&1 == 1, 128)
+	}
+}
+
+// propagate a carry into the bytes already written
+func (b *boolEncoder) carry() {
+	for i := len(b.buf) - 1; i >= 0; i-- {
+		b.buf[i]++
+		if b.buf[i] != 0 {
+			return
+		}
+	}
+}
+
+func (b *boolEncoder) flush() []byte {
+	if b.rng == 0 {
+		b.rng, b.bitCount = 255, 24
+	}
+	c := b.bitCount
+	v := b.bottom
+	if v&(1<<(32-c)) != 0 {
+		b.carry()
+	}
+	v <<= c & 7
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for range 4 {
+		b.buf = append(b.buf, byte(v>>24))
+		v <<= 8
+	}
+	return b.buf
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// a smooth photo-like image with some grain, so every token category gets used
+func testPhoto(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	seed := uint32(7)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			seed = seed*1664525 + 1013904223
+			grain := int(seed>>28) - 8
+			fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+			r := 128 + 100*math.Sin(6*fx+2*fy)
+			g := 128 + 90*math.Cos(5*fy-3*fx)
+			b := 255 * fx * fy
+			img.SetRGBA(x, y, color.RGBA{clampByte(int(r) + grain), clampByte(int(g) + grain), clampByte(int(b) + grain), 255})
+		}
+	}
+	return img
+}
+
+func clampByte(v int) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
+
+// with the loop filter off the decoder must land on exactly the pixels the encoder
+// predicted from, any difference would drift across the image
+func TestLossyWebPMatchesDecoder(t *testing.T) {
+	noise := image.NewRGBA(image.Rect(0, 0, 45, 30))
+	seed := uint32(1)
+	for i := range noise.Pix {
+		seed = seed*1664525 + 1013904223
+		noise.Pix[i] = uint8(seed >> 24)
+	}
+	flat := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for i := range flat.Pix {
+		flat.Pix[i] = 200
+	}
+
+	tests := []struct {
+		name string
+		img  *image.RGBA
+	}{
+		{"photo", testPhoto(160, 96)},
+		{"odd size", testPhoto(37, 23)},
+		{"single pixel", testPhoto(1, 1)},
+		{"noise", noise},
+		{"flat", flat},
+	}
+	for _, tt := range tests {
+		for _, quality := range []int{0, 50, 85, 100} {
+			b := tt.img.Bounds()
+			e := newVP8Encoder(b.Dx(), b.Dy(), quality)
+			e.filterLevel = 0
+			e.importImage(tt.img)
+			data, err := e.encode()
+			if err != nil {
+				t.Fatalf("%s at quality %d: %v", tt.name, quality, err)
+			}
+			m, format, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s at quality %d does not decode: %v", tt.name, quality, err)
+			}
+			got, ok := m.(*image.YCbCr)
+			if format != "webp" || !ok || got.Bounds() != b {
+				t.Fatalf("%s at quality %d decoded as %s %T %v", tt.name, quality, format, m, m.Bounds())
+			}
+
+			mismatches := 0
+			for y := 0; y < b.Dy(); y++ {
+				for x := 0; x < b.Dx(); x++ {
+					if got.Y[y*got.YStride+x] != e.ry[y*16*e.mbw+x] {
+						mismatches++
+					}
+				}
+			}
+			for y := 0; y < (b.Dy()+1)/2; y++ {
+				for x := 0; x < (b.Dx()+1)/2; x++ {
+					if got.Cb[y*got.CStride+x] != e.ru[y*8*e.mbw+x] || got.Cr[y*got.CStride+x] != e.rv[y*8*e.mbw+x] {
+						mismatches++
+					}
+				}
+			}
+			if mismatches > 0 {
+				t.Errorf("%s at quality %d: %d samples differ from the encoder's reconstruction", tt.name, quality, mismatches)
+			}
+		}
+	}
+}
+
+func TestLossyWebPQuality(t *testing.T) {
+	img := testPhoto(320, 200)
+	ref := newVP8Encoder(320, 200, 0)
+	ref.importImage(img)
+
+	var lastSize int
+	for _, quality := range []int{50, 85, 100} {
+		var buf bytes.Buffer
+		if err := encodeLossyWebP(&buf, img, quality); err != nil {
+			t.Fatal(err)
+		}
+		size := buf.Len()
+		m, _, err := image.Decode(&buf)
+		if err != nil {
+			t.Fatalf("quality %d does not decode: %v", quality, err)
+		}
+		got := m.(*image.YCbCr)
+
+		var sum float64
+		for y := 0; y < 200; y++ {
+			for x := 0; x < 320; x++ {
+				d := float64(got.Y[y*got.YStride+x]) - float64(ref.y[y*16*ref.mbw+x])
+				sum += d * d
+			}
+		}
+		psnr := 10 * math.Log10(255*255/(sum/(320*200)))
+		if psnr < 30 {
+			t.Errorf("quality %d has a luma PSNR of %.1f dB, want at least 30", quality, psnr)
+		}
+		if size <= lastSize {
+			t.Errorf("quality %d takes %d bytes, no more than the %d of a lower quality", quality, size, lastSize)
+		}
+		lastSize = size
+	}
+}
+
+func TestLossyWebPDimensions(t *testing.T) {
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 0, 10), image.Rect(0, 0, 16384, 1)} {
+		if err := encodeLossyWebP(&bytes.Buffer{}, image.NewRGBA(r), 85); err == nil {
+			t.Errorf("encoding a %v image succeeded", r)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// refresh tokens rotate on every use, so concurrent 401s share one refresh request
+let refreshing = null;
+
+// trade the refresh token for a new token pair, resolving to the new access token or null
+export const refreshSession = () => {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = localStorage.getItem("refresh_token");
+      if (!refreshToken) {
+        return null;
+      }
+
+      const response = await fetch("http://localhost:8000/api/admin/refresh", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ refresh_token: refreshToken }),
+      });
+      if (!response.ok) {
+        localStorage.removeItem("refresh_token");
+        return null;
+      }
+
+      const data = await response.json();
+      localStorage.setItem("token", data.token);
+      localStorage.setItem("refresh_token", data.refresh_token);
+      return data.token;
+    })()
+      .catch((error) => {
+        console.error("error refreshing session:", error);
+        return null;
+      })
+      .finally(() => {
+        refreshing = null;
+      });
+  }
+  return refreshing;
+};
+
+// fetch with the access token, refreshing it once and retrying when it has expired.
+// a 401 that survives the refresh is returned for the caller to send the user to the login
+export const authFetch = async (url, options = {}) => {
+  const send = (token) =>
+    fetch(url, {
+      ...options,
+      headers: {
+        ...options.headers,
+        Authorization: `Bearer ${token}`,
+      },
+    });
+
+  const response = await send(localStorage.getItem("token"));
+  if (response.status !== 401) {
+    return response;
+  }
+  const token = await refreshSession();
+  return token ? send(token) : response;
+};
+
+// revoke the access token and the refresh token's family on the server, then forget both.
+// the tokens are cleared even when the request fails, the user asked to be logged out
+export const logout = async () => {
+  try {
+    await authFetch("http://localhost:8000/api/admin/logout", {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+      },
+      body: JSON.stringify({ refresh_token: localStorage.getItem("refresh_token") }),
+    });
+  } catch (error) {
+    console.error("error logging out:", error);
+  } finally {
+    localStorage.removeItem("token");
+    localStorage.removeItem("refresh_token");
+  }
+};
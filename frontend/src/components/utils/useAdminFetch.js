@@ -0,0 +1,46 @@
+import { useCallback, useEffect, useState } from "react";
+import { authFetch } from "./session";
+
+// fetches an authenticated admin endpoint on the client, drafts are only served there.
+// an expired token is refreshed once, the login page is only shown when that fails.
+// a null url defers the request, e.g. until the router query is ready
+const useAdminFetch = (url) => {
+  const [data, setData] = useState(null);
+  const [loading, setLoading] = useState(true);
+
+  const load = useCallback(async () => {
+    if (!url) {
+      return;
+    }
+
+    if (!localStorage.getItem("token")) {
+      window.location.href = "/admin/login";
+      return;
+    }
+
+    try {
+      const response = await authFetch(url);
+      if (response.status === 401) {
+        window.location.href = "/admin/login";
+        return;
+      }
+      if (!response.ok) {
+        throw new Error("Failed to fetch admin data");
+      }
+      setData(await response.json());
+    } catch (error) {
+      console.error("error:", error);
+      setData(null);
+    } finally {
+      setLoading(false);
+    }
+  }, [url]);
+
+  useEffect(() => {
+    load();
+  }, [load]);
+
+  return { data, loading, reload: load };
+};
+
+export default useAdminFetch;
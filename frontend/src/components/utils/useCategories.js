@@ -0,0 +1,17 @@
+import { useEffect, useState } from "react";
+
+// the categories works can be filed under, in display order
+const useCategories = () => {
+  const [categories, setCategories] = useState([]);
+
+  useEffect(() => {
+    fetch("http://localhost:8000/api/categories")
+      .then((response) => (response.ok ? response.json() : []))
+      .then(setCategories)
+      .catch((error) => console.error("error fetching categories:", error));
+  }, []);
+
+  return categories;
+};
+
+export default useCategories;
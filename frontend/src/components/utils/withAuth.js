@@ -1,5 +1,6 @@
 import { useEffect, useState } from "react";
 import { useRouter } from "next/router";
+import { authFetch } from "./session";
 
 const withAuth = (WrappedComponent) => {
   return function ProtectedPage(props) {
@@ -17,12 +18,8 @@ const withAuth = (WrappedComponent) => {
           return;
         }
 
-        const response = await fetch("http://localhost:8000/api/admin", {
-          method: "GET",
-          headers: {
-            Authorization: `Bearer ${token}`,
-          },
-        });
+        // access tokens are short-lived, authFetch rotates the refresh token and tries once more
+        const response = await authFetch("http://localhost:8000/api/admin");
 
         if (response.status === 401) {
           setLoading(false);
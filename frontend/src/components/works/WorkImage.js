@@ -0,0 +1,58 @@
+// webp goes first only when every webp variant is lighter than the other format at its width,
+// browsers take the first source they support
+const sourceTypes = (variants) => {
+  const webp = variants.filter((v) => v.content_type === "image/webp");
+  const lighter =
+    webp.length > 0 &&
+    webp.every((w) =>
+      variants.some(
+        (v) => v.content_type !== "image/webp" && v.width === w.width && w.bytes && v.bytes && w.bytes < v.bytes
+      )
+    );
+  return lighter ? ["image/webp", "image/jpeg", "image/png"] : ["image/jpeg", "image/png", "image/webp"];
+};
+
+// one image of a work with its responsive variants, caption and EXIF line
+const WorkImage = ({ image, title, pixelated }) => {
+  const exif = image.exif;
+  return (
+    <figure className="mb-2">
+      <picture>
+        {sourceTypes(image.variants || []).map((type) => {
+          const variants = (image.variants || []).filter((v) => v.content_type === type);
+          return variants.length > 0 ? (
+            <source
+              key={type}
+              type={type}
+              srcSet={variants.map((v) => `${v.url} ${v.width}w`).join(", ")}
+              sizes="(min-width: 1024px) 28rem, 20rem"
+            />
+          ) : null;
+        })}
+        <img
+          className="w-full max-w-xs lg:max-w-md h-auto"
+          style={pixelated ? { imageRendering: "pixelated" } : undefined}
+          src={image.url}
+          alt={image.alt || title}
+        />
+      </picture>
+      {image.caption && <figcaption className="text-sm mt-1">{image.caption}</figcaption>}
+      {exif && (
+        <p className="text-sm text-gray-500">
+          {[
+            exif.camera,
+            exif.lens,
+            exif.focal_length && `${exif.focal_length}mm`,
+            exif.f_number && `f/${exif.f_number}`,
+            exif.exposure_time && `${exif.exposure_time}s`,
+            exif.iso && `ISO ${exif.iso}`,
+          ]
+            .filter(Boolean)
+            .join(" · ")}
+        </p>
+      )}
+    </figure>
+  );
+};
+
+export default WorkImage;
@@ -1,9 +1,18 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
+import { logout } from "@/components/utils/session";
 import withAuth from "@/components/utils/withAuth";
 import Link from "next/link";
+import { useRouter } from "next/router";
 
 const Dashboard = () => {
+  const router = useRouter();
+
+  const handleLogout = async () => {
+    await logout();
+    router.push("/admin/login");
+  };
+
   return (
     <Layout>
       <PageHead headTitle={`dashboard`} />
@@ -28,6 +37,15 @@ const Dashboard = () => {
                   works
                 </Link>
               </li>
+              <li>
+                <button
+                  type="button"
+                  className="header-item"
+                  onClick={handleLogout}
+                >
+                  log out
+                </button>
+              </li>
             </ul>
           </div>
         </div>
@@ -6,6 +6,8 @@ import { useEffect, useState } from "react";
 const Login = () => {
   const [username, setUsername] = useState("");
   const [password, setPassword] = useState("");
+  const [mfaToken, setMfaToken] = useState("");
+  const [code, setCode] = useState("");
   const [error, setError] = useState("");
   const [loading, setLoading] = useState(false);
   const router = useRouter();
@@ -22,19 +24,37 @@ const Login = () => {
     setError("");
 
     try {
-      const response = await fetch("http://localhost:8000/api/admin/login", {
-        method: "POST",
-        headers: {
-          "Content-Type": "application/json",
-        },
-        body: JSON.stringify({ username, password }),
-      });
+      // the second step exchanges the mfa token and an authenticator code for the real tokens
+      const response = mfaToken
+        ? await fetch("http://localhost:8000/api/admin/login/totp", {
+            method: "POST",
+            headers: {
+              "Content-Type": "application/json",
+            },
+            body: JSON.stringify({ mfa_token: mfaToken, code }),
+          })
+        : await fetch("http://localhost:8000/api/admin/login", {
+            method: "POST",
+            headers: {
+              "Content-Type": "application/json",
+            },
+            body: JSON.stringify({ username, password }),
+          });
 
+      if (response.status === 429) {
+        throw new Error("too many attempts, try again later!");
+      }
       if (!response.ok) {
-        throw new Error("invalid credentials!");
+        throw new Error(mfaToken ? "invalid code!" : "invalid credentials!");
       }
       const data = await response.json();
+      if (data.mfa_required) {
+        setMfaToken(data.mfa_token);
+        setLoading(false);
+        return;
+      }
       localStorage.setItem("token", data.token);
+      localStorage.setItem("refresh_token", data.refresh_token);
       setLoading(false);
       router.push("./dashboard");
     } catch (err) {
@@ -88,6 +108,26 @@ const Login = () => {
                   className="bg-transparent border border-red-600 rounded mb-2 focus:outline-none"
                   required
                 />
+                {mfaToken && (
+                  <>
+                    <label
+                      htmlFor="code"
+                      className="block"
+                    >
+                      authenticator or recovery code
+                    </label>
+                    <input
+                      id="code"
+                      name="code"
+                      type="text"
+                      autoComplete="one-time-code"
+                      value={code}
+                      onChange={(e) => setCode(e.target.value)}
+                      className="bg-transparent border border-red-600 rounded mb-2 focus:outline-none"
+                      required
+                    />
+                  </>
+                )}
               </div>
               {error && <p className="text-red-600">{error}</p>}
               <div className="mt-2">
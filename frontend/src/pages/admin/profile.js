@@ -1,5 +1,6 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
+import { authFetch } from "@/components/utils/session";
 import withAuth from "@/components/utils/withAuth";
 import Link from "next/link";
 import { useEffect, useState } from "react";
@@ -18,11 +19,7 @@ const Profile = () => {
       }
 
       try {
-        const response = await fetch("http://localhost:8000/api/users/1", {
-          headers: {
-            Authorization: `Bearer ${token}`,
-          },
-        });
+        const response = await authFetch("http://localhost:8000/api/users/me");
 
         if (!response.ok) {
           throw new Error("Failed to fetch user data. Redirecting to login...");
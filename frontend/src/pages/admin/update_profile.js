@@ -1,11 +1,13 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
+import { authFetch } from "@/components/utils/session";
 import withAuth from "@/components/utils/withAuth";
 import Link from "next/link";
 import { useRouter } from "next/router";
 import { useEffect, useState } from "react";
 
 const UpdateProfile = () => {
+  const [userId, setUserId] = useState(null);
   const [username, setUsername] = useState("");
   const [email, setEmail] = useState("");
   const [error, setError] = useState("");
@@ -24,17 +26,14 @@ const UpdateProfile = () => {
       }
 
       try {
-        const response = await fetch("http://localhost:8000/api/users/1", {
-          headers: {
-            Authorization: `Bearer ${token}`,
-          },
-        });
+        const response = await authFetch("http://localhost:8000/api/users/me");
 
         if (!response.ok) {
           throw new Error("Failed to fetch user data. Redirecting to login...");
         }
 
         const data = await response.json();
+        setUserId(data.id);
         setUsername(data.username || "");
         setEmail(data.email || "");
         setLoading(false);
@@ -68,11 +67,10 @@ const UpdateProfile = () => {
         return;
       }
 
-      const response = await fetch("http://localhost:8000/api/users/1", {
+      const response = await authFetch(`http://localhost:8000/api/users/${userId}`, {
         method: "PUT",
         headers: {
           "Content-Type": "application/json",
-          Authorization: `Bearer ${token}`,
         },
         body: JSON.stringify({
           username,
@@ -80,10 +78,21 @@ const UpdateProfile = () => {
         }),
       });
 
+      if (response.status === 401) {
+        window.location.href = "/admin/login";
+        return;
+      }
       if (!response.ok) {
         throw new Error("Invalid field values!");
       }
 
+      // a new username ends the old sessions, the response carries tokens for this one
+      const data = await response.json();
+      if (data.tokens) {
+        localStorage.setItem("token", data.tokens.token);
+        localStorage.setItem("refresh_token", data.tokens.refresh_token);
+      }
+
       router.push("/admin/profile");
     } catch (error) {
       setError(error.message);
@@ -1,47 +1,27 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
+import { authFetch } from "@/components/utils/session";
+import useAdminFetch from "@/components/utils/useAdminFetch";
 import withAuth from "@/components/utils/withAuth";
 import Link from "next/link";
 import { useRouter } from "next/router";
 import { useState } from "react";
 
-export async function getServerSideProps(context) {
-  const { id } = context.params;
-
-  try {
-    const response = await fetch(`http://goapp:8000/api/work/${id}`);
-    if (!response.ok) {
-      throw new Error("Failed to fetch work data");
-    }
-    const work = await response.json();
-    return {
-      props: { work },
-    };
-  } catch (error) {
-    console.error("Error fetching work:", error);
-    return {
-      props: { work: null },
-    };
-  }
-}
-
 const deleteWork = async (workId) => {
-  const token = localStorage.getItem("token");
-  if (!token) {
+  if (!localStorage.getItem("token")) {
     window.location.href = "/admin/login";
     return false;
   }
 
   try {
-    const response = await fetch(`http://localhost:8000/api/works/${workId}`, {
+    const response = await authFetch(`http://localhost:8000/api/works/${workId}`, {
       method: "DELETE",
-      headers: {
-        Authorization: `Bearer ${token}`,
-      },
     });
 
-    console.log("Response details:", response);
-
+    if (response.status === 401) {
+      window.location.href = "/admin/login";
+      return false;
+    }
     if (!response.ok) {
       const errorText = await response.text();
       throw new Error(`Failed to delete the work: ${errorText}`);
@@ -53,18 +33,15 @@ const deleteWork = async (workId) => {
   }
 };
 
-const EditWork = ({ work }) => {
+const EditWork = () => {
   const router = useRouter();
   const [isHovered, setIsHovered] = useState(false);
+  const { data: work, loading, reload } = useAdminFetch(
+    router.isReady ? `http://localhost:8000/api/admin/works/${router.query.id}` : null
+  );
 
   const handleDelete = async () => {
-    const token = localStorage.getItem("token");
-    if (!token) {
-      router.push("/admin/login");
-      return;
-    }
-
-    const success = await deleteWork(work.id, token);
+    const success = await deleteWork(work.id);
     if (success) {
       router.push("/admin/works");
     } else {
@@ -73,30 +50,37 @@ const EditWork = ({ work }) => {
   };
 
   const handlePublish = async () => {
-    const token = localStorage.getItem("token");
-    if (!token) {
+    if (!localStorage.getItem("token")) {
       router.push("/admin/login");
       return;
     }
 
     try {
-      const response = await fetch(`http://localhost:8000/api/work/${work.id}`, {
-        method: "PUT",
-        headers: {
-          Authorization: `Bearer ${token}`,
-        },
+      const action = work.is_published ? "unpublish" : "publish";
+      const response = await authFetch(`http://localhost:8000/api/works/${work.id}/${action}`, {
+        method: "POST",
       });
 
-      if (!response.ok) {
+      if (response.status === 401) {
+        router.push("/admin/login");
+        return;
+      }
+      // 409 means another request already made the change, the reload shows the current state
+      if (!response.ok && response.status !== 409) {
         throw new Error("Failed to change work visibility");
       }
 
-      router.replace(router.asPath);
+      reload();
     } catch (error) {
       console.error("Error changing work visibility:", error.message);
+      alert(error.message);
     }
   };
 
+  if (loading) {
+    return null;
+  }
+
   if (!work) {
     return (
       <Layout>
@@ -134,7 +118,7 @@ const EditWork = ({ work }) => {
                 ) : (
                   <img
                     className="w-full max-w-xs lg:max-w-md h-auto"
-                    src={`/works/${work.image_name}`}
+                    src={work.image_url}
                     alt={work.title}
                   />
                 )}
@@ -1,30 +1,23 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
+import { authFetch } from "@/components/utils/session";
+import useAdminFetch from "@/components/utils/useAdminFetch";
+import useCategories from "@/components/utils/useCategories";
 import withAuth from "@/components/utils/withAuth";
 import Link from "next/link";
 import { useRouter } from "next/router";
 import { useState } from "react";
 
-export async function getServerSideProps({ params }) {
-  const { id } = params;
-  try {
-    const response = await fetch(`http://goapp:8000/api/work/${id}`);
-    if (!response.ok) {
-      throw new Error("Could not fetch the work data");
-    }
-    const work = await response.json();
-    return {
-      props: { work },
-    };
-  } catch (error) {
-    console.error("Error fetching work:", error);
-    return {
-      props: { work: null },
-    };
+const UpdateWork = () => {
+  const router = useRouter();
+  const { data: work, loading } = useAdminFetch(
+    router.isReady ? `http://localhost:8000/api/admin/works/${router.query.id}` : null
+  );
+
+  if (loading) {
+    return null;
   }
-}
 
-const UpdateWork = ({ work }) => {
   if (!work) {
     return (
       <Layout>
@@ -44,15 +37,21 @@ const UpdateWork = ({ work }) => {
     );
   }
 
+  return <UpdateWorkForm work={work} />;
+};
+
+const UpdateWorkForm = ({ work }) => {
   const [title, setTitle] = useState(work?.title || "");
   const [author, setAuthor] = useState(work?.author || "");
   const [contentType] = useState(work?.content_type || "");
   const [category, setCategory] = useState(work?.category || "");
   const [content, setContent] = useState(work?.content || "");
+  const [tags, setTags] = useState((work?.tags || []).join(", "));
   const [imageFile, setImageFile] = useState(null);
   const [imageName] = useState(work?.image_name || null);
   const [error, setError] = useState("");
   const router = useRouter();
+  const categories = useCategories();
 
   const handleFileChange = (e) => {
     setImageFile(e.target.files[0]);
@@ -71,7 +70,7 @@ const UpdateWork = ({ work }) => {
       return;
     }
 
-    if (!["story", "poem", "digital-art", "pixel-art", "glitch-art", "photography"].includes(category)) {
+    if (!categories.some((c) => c.slug === category && c.content_type === contentType)) {
       setError("Content type and category do not match!");
       return;
     }
@@ -88,6 +87,7 @@ const UpdateWork = ({ work }) => {
     formData.append("author", author);
     formData.append("content_type", contentType);
     formData.append("category", category);
+    formData.append("tags", tags);
 
     if (contentType === "text") {
       formData.append("content", content);
@@ -96,16 +96,18 @@ const UpdateWork = ({ work }) => {
     }
 
     try {
-      const response = await fetch(`http://localhost:8000/api/works/${work.id}`, {
+      const response = await authFetch(`http://localhost:8000/api/works/${work.id}`, {
         method: "PUT",
-        headers: {
-          Authorization: `Bearer ${token}`,
-        },
         body: formData,
       });
 
+      if (response.status === 401) {
+        window.location.href = "/admin/login";
+        return;
+      }
       if (!response.ok) {
-        throw new Error("Failed to update the work");
+        const body = await response.json().catch(() => null);
+        throw new Error(body?.error || "Failed to update the work");
       }
 
       router.push(`/admin/works/${work.id}`);
@@ -138,13 +140,31 @@ const UpdateWork = ({ work }) => {
               onChange={(e) => setAuthor(e.target.value)}
               type="text"
             />
-            <label className="block">category</label>
+            <label className="block">tags</label>
             <input
               className="input-section"
-              value={category}
-              onChange={(e) => setCategory(e.target.value)}
+              value={tags}
+              onChange={(e) => setTags(e.target.value)}
               type="text"
+              placeholder="comma separated"
             />
+            <label className="block">category</label>
+            <select
+              className="input-section px-2"
+              value={category}
+              onChange={(e) => setCategory(e.target.value)}
+            >
+              {categories
+                .filter((c) => c.content_type === contentType)
+                .map((c) => (
+                  <option
+                    key={c.slug}
+                    value={c.slug}
+                  >
+                    {c.name}
+                  </option>
+                ))}
+            </select>
             {contentType === "text" && (
               <div>
                 <label className="block">content</label>
@@ -163,14 +183,14 @@ const UpdateWork = ({ work }) => {
                   <p>/old image</p>
                   <img
                     className="w-full max-w-xs lg:max-w-sm h-auto"
-                    src={`/works/${imageName}`}
+                    src={work.image_url}
                     alt={title}
                   />
                 </div>
 
                 <input
                   type="file"
-                  accept="image/*"
+                  accept="image/png,image/gif,image/jpeg,image/webp"
                   id="file-upload"
                   className="hidden"
                   onChange={handleFileChange}
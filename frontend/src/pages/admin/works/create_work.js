@@ -1,5 +1,7 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
+import { authFetch } from "@/components/utils/session";
+import useCategories from "@/components/utils/useCategories";
 import withAuth from "@/components/utils/withAuth";
 import Link from "next/link";
 import { useRouter } from "next/router";
@@ -11,19 +13,22 @@ const CreateWork = () => {
   const [category, setCategory] = useState("");
   const [contentType, setContentType] = useState("");
   const [content, setContent] = useState("");
-  const [file, setFile] = useState(null);
+  const [tags, setTags] = useState("");
+  const [draft, setDraft] = useState(false);
+  const [publishAt, setPublishAt] = useState("");
+  const [files, setFiles] = useState([]);
   const [error, setError] = useState("");
   const router = useRouter();
+  const categories = useCategories();
 
   const handleSelectChange = (e) => {
     const selectedCategory = e.target.value;
     setCategory(selectedCategory);
     setError("");
 
-    if (selectedCategory === "poem" || selectedCategory === "story") {
-      setContentType("text");
-    } else if (["digital-art", "pixel-art", "glitch-art", "photography"].includes(selectedCategory)) {
-      setContentType("image");
+    const selected = categories.find((c) => c.slug === selectedCategory);
+    if (selected) {
+      setContentType(selected.content_type);
     } else {
       setContentType("");
       setError("Content type and category do not match.");
@@ -31,14 +36,13 @@ const CreateWork = () => {
   };
 
   const handleFileChange = (e) => {
-    const selectedFile = e.target.files[0];
-    setFile(selectedFile);
+    setFiles(Array.from(e.target.files));
   };
 
   const handleSubmit = async (e) => {
     e.preventDefault();
 
-    if (!title || !author || !category || (contentType === "text" && !content) || (contentType === "image" && !file)) {
+    if (!title || !author || !category || (contentType === "text" && !content) || (contentType === "image" && files.length === 0)) {
       setError("Please fill out all fields!");
       return;
     }
@@ -59,23 +63,32 @@ const CreateWork = () => {
       formData.append("author", author);
       formData.append("category", category);
       formData.append("content_type", contentType);
+      formData.append("tags", tags);
+      if (draft) {
+        formData.append("draft", "true");
+      }
+      if (publishAt) {
+        formData.append("publish_at", new Date(publishAt).toISOString());
+      }
 
       if (contentType === "text") {
         formData.append("content", content);
       } else if (contentType === "image") {
-        formData.append("file", file);
+        files.forEach((f) => formData.append("file", f));
       }
 
-      const response = await fetch("http://localhost:8000/api/works", {
+      const response = await authFetch("http://localhost:8000/api/works", {
         method: "POST",
-        headers: {
-          Authorization: `Bearer ${token}`,
-        },
         body: formData,
       });
 
+      if (response.status === 401) {
+        window.location.href = "/admin/login";
+        return;
+      }
       if (!response.ok) {
-        throw new Error("Invalid field values or server error!");
+        const body = await response.json().catch(() => null);
+        throw new Error(body?.error || "Invalid field values or server error!");
       }
 
       router.push("/admin/works");
@@ -109,6 +122,14 @@ const CreateWork = () => {
                   className="input-section pl-2"
                   required
                 />
+                <label className="block">Tags</label>
+                <input
+                  type="text"
+                  value={tags}
+                  onChange={(e) => setTags(e.target.value)}
+                  className="input-section pl-2"
+                  placeholder="comma separated"
+                />
                 <label className="block">Category</label>
                 <select
                   id="dropdown"
@@ -120,12 +141,14 @@ const CreateWork = () => {
                   <option value="" disabled>
                     Category
                   </option>
-                  <option value="poem">Poem</option>
-                  <option value="story">Story</option>
-                  <option value="digital-art">Digital Art</option>
-                  <option value="pixel-art">Pixel Art</option>
-                  <option value="glitch-art">Glitch Art</option>
-                  <option value="photography">Photography</option>
+                  {categories.map((c) => (
+                    <option
+                      key={c.slug}
+                      value={c.slug}
+                    >
+                      {c.name}
+                    </option>
+                  ))}
                 </select>
                 {contentType === "text" && (
                   <div className="mb-2">
@@ -144,24 +167,43 @@ const CreateWork = () => {
                   <div className="mb-2">
                     <input
                       type="file"
-                      accept="image/*"
+                      accept="image/png,image/gif,image/jpeg,image/webp"
                       id="file-upload"
                       className="hidden"
                       onChange={handleFileChange}
+                      multiple
                       required
                     />
                     <label
                       htmlFor="file-upload"
                       className="block input-section w-1/12 text-center"
                     >
-                      Upload Image
+                      Upload Images
                     </label>
                     <p className="mt-2 text-zinc-300">
-                      {file ? file.name : "No file selected."}
+                      {files.length > 0 ? files.map((f) => f.name).join(", ") : "No file selected."}
                     </p>
                   </div>
                 )}
               </div>
+              <div className="mb-2">
+                <label className="mr-2">
+                  <input
+                    type="checkbox"
+                    checked={draft}
+                    onChange={(e) => setDraft(e.target.checked)}
+                    className="mr-1"
+                  />
+                  Save as draft
+                </label>
+                <label className="block">Publish at (optional)</label>
+                <input
+                  type="datetime-local"
+                  value={publishAt}
+                  onChange={(e) => setPublishAt(e.target.value)}
+                  className="input-section px-2"
+                />
+              </div>
               {error && <p className="text-red-600 mb-2">{error}</p>}
               <div>
                 <button
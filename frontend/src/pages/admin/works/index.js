@@ -1,26 +1,26 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
+import useAdminFetch from "@/components/utils/useAdminFetch";
 import withAuth from "@/components/utils/withAuth";
 import Link from "next/link";
-import { useEffect } from "react";
+import { useEffect, useState } from "react";
 
-export async function getServerSideProps() {
-  try {
-    const response = await fetch("http://goapp:8000/api/works");
-    const works = await response.json();
+const Works = () => {
+  // pages are appended as "load more" follows next_cursor
+  const [cursor, setCursor] = useState("");
+  const [works, setWorks] = useState([]);
+  const query = cursor ? `&cursor=${encodeURIComponent(cursor)}` : "";
+  const { data } = useAdminFetch(`http://localhost:8000/api/admin/works?limit=100${query}`);
 
-    return {
-      props: { works },
-    };
-  } catch (error) {
-    console.error("error:", error);
-    return {
-      props: { works: [] },
-    };
-  }
-}
+  useEffect(() => {
+    if (data?.works) {
+      setWorks((loaded) => {
+        const seen = new Set(loaded.map((work) => work.id));
+        return [...loaded, ...data.works.filter((work) => !seen.has(work.id))];
+      });
+    }
+  }, [data]);
 
-const Works = ({ works }) => {
   return (
     <>
       <Layout>
@@ -61,6 +61,14 @@ const Works = ({ works }) => {
                     <p className="my-1">no works found.</p>
                   )}
                 </ul>
+                {data?.next_cursor && (
+                  <button
+                    className="red-underline"
+                    onClick={() => setCursor(data.next_cursor)}
+                  >
+                    load more
+                  </button>
+                )}
               </div>
             </div>
             <Link
@@ -1,6 +1,7 @@
 import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
 import { formatDate } from "@/components/utils/date";
+import WorkImage from "@/components/works/WorkImage";
 import Link from "next/link";
 
 export async function getServerSideProps(context) {
@@ -11,8 +12,11 @@ export async function getServerSideProps(context) {
       throw new Error("failed to fetch data");
     }
     const workData = await response.json();
+    // the category decides whether images are rendered without smoothing
+    const categories = await fetch("http://goapp:8000/api/categories").then((r) => (r.ok ? r.json() : []));
+    const pixelated = categories.some((c) => c.slug === workData.category && c.pixelated);
     return {
-      props: { workData },
+      props: { workData, pixelated },
     };
   } catch (error) {
     console.error("error fetching work:", error);
@@ -22,7 +26,7 @@ export async function getServerSideProps(context) {
   }
 }
 
-export default function Work({ workData }) {
+export default function Work({ workData, pixelated }) {
   if (!workData || !workData.is_published) {
     return (
       <Layout>
@@ -57,16 +61,32 @@ export default function Work({ workData }) {
                 {workData.content_type === "text" ? (
                   <p className="w-fit">{workData.content}</p>
                 ) : (
-                  <img
-                    className="w-full max-w-xs lg:max-w-md h-auto"
-                    src={`/works/${workData.image_name}`}
-                    alt={workData.title}
-                  />
+                  (workData.images || []).map((image) => (
+                    <WorkImage
+                      key={image.id}
+                      image={image}
+                      title={workData.title}
+                      pixelated={pixelated}
+                    />
+                  ))
                 )}
               </div>
 
               <p className="text-red-600">- {workData.author}</p>
               <p>{formatDate(workData.created_at)}</p>
+              {workData.tags && workData.tags.length > 0 && (
+                <p>
+                  {workData.tags.map((tag) => (
+                    <Link
+                      key={tag}
+                      href={`/works?tag=${encodeURIComponent(tag)}`}
+                      className="text-red-700 mr-2"
+                    >
+                      #{tag}
+                    </Link>
+                  ))}
+                </p>
+              )}
             </div>
             <Link
               className="red-underline"
@@ -5,18 +5,22 @@ import Link from "next/link";
 
 export async function getServerSideProps(context) {
   const { category } = context.params;
+  const { cursor } = context.query;
 
-  const works = await fetch(`http://goapp:8000/api/works/${category}`).then((res) => res.json());
+  const query = cursor ? `&cursor=${encodeURIComponent(cursor)}` : "";
+  const page = await fetch(`http://goapp:8000/api/works/${category}?limit=100${query}`).then((res) => res.json());
 
   return {
     props: {
       category,
-      works,
+      works: page.works || [],
+      paged: !!cursor,
+      nextCursor: page.next_cursor || null,
     },
   };
 }
 
-export default function Category({ category, works }) {
+export default function Category({ category, works, paged, nextCursor }) {
   return (
     <>
       <Layout>
@@ -56,6 +60,24 @@ export default function Category({ category, works }) {
                   <p>no works available</p>
                 </div>
               )}
+              <p className="mt-2">
+                {paged && (
+                  <Link
+                    className="red-underline mr-4"
+                    href={`/works/${category}`}
+                  >
+                    first page
+                  </Link>
+                )}
+                {nextCursor && (
+                  <Link
+                    className="red-underline"
+                    href={`/works/${category}?cursor=${encodeURIComponent(nextCursor)}`}
+                  >
+                    more works
+                  </Link>
+                )}
+              </p>
             </div>
             <Link
               className="red-underline"
@@ -2,13 +2,18 @@ import Layout from "@/components/layout/Layout";
 import PageHead from "@/components/layout/PageHead";
 import Link from "next/link";
 
-export async function getServerSideProps() {
+export async function getServerSideProps(context) {
+  const { tag, cursor } = context.query;
   try {
-    const response = await fetch("http://goapp:8000/api/works");
-    const works = await response.json();
+    let query = tag ? `&tag=${encodeURIComponent(tag)}` : "";
+    if (cursor) {
+      query += `&cursor=${encodeURIComponent(cursor)}`;
+    }
+    const response = await fetch(`http://goapp:8000/api/works?limit=100${query}`);
+    const page = await response.json();
 
     return {
-      props: { works: works || [] },
+      props: { works: page.works || [], tag: tag || null, paged: !!cursor, nextCursor: page.next_cursor || null },
     };
   } catch (error) {
     console.error("error fetching works:", error);
@@ -18,7 +23,20 @@ export async function getServerSideProps() {
   }
 }
 
-export default function Works({ works }) {
+// link to another page of the listing, keeping the tag filter
+const pageHref = (tag, cursor) => {
+  const params = new URLSearchParams();
+  if (tag) {
+    params.set("tag", tag);
+  }
+  if (cursor) {
+    params.set("cursor", cursor);
+  }
+  const query = params.toString();
+  return query ? `/works?${query}` : "/works";
+};
+
+export default function Works({ works, tag, paged, nextCursor }) {
   const groupedWorks = works.reduce((acc, work) => {
     if (work.is_published) {
       acc[work.category] = acc[work.category] || [];
@@ -33,6 +51,7 @@ export default function Works({ works }) {
       <div className="flex justify-center">
         <div className="w-8/12">
           <p className="text-3xl mb-4 font-black red-underline">works</p>
+          {tag && <p className="mb-4">tagged #{tag}</p>}
           {Object.keys(groupedWorks).length > 0 ? (
             Object.entries(groupedWorks).map(([category, works]) => (
               <div
@@ -67,6 +86,24 @@ export default function Works({ works }) {
               <p>please be patient for the person to show off them extraordinarily amazing artistic work</p>
             </div>
           )}
+          <p>
+            {paged && (
+              <Link
+                href={pageHref(tag)}
+                className="red-underline mr-4"
+              >
+                first page
+              </Link>
+            )}
+            {nextCursor && (
+              <Link
+                href={pageHref(tag, nextCursor)}
+                className="red-underline"
+              >
+                more works
+              </Link>
+            )}
+          </p>
         </div>
       </div>
     </Layout>